@@ -0,0 +1,313 @@
+package hourglass
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// OnTime is the default tolerance used to decide whether an event started on
+// time.
+const OnTime = 5 * time.Minute
+
+// Distribution summarizes a set of durations given in seconds.
+type Distribution struct {
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	P90    float64 `json:"p90"`
+}
+
+// Timing compares the planned (dtstart/dtend) and the actual (rtstart/rtend)
+// times of the events of a category and a source. Delay is the difference
+// between the actual and the planned start, Overrun the difference between the
+// actual and the planned duration. Only the events, not canceled, whose actual
+// times have been recorded are measured. Canceled counts both the events in
+// the canceled state and the deleted ones.
+type Timing struct {
+	Category  string       `json:"category"`
+	Source    string       `json:"source"`
+	Count     int          `json:"count"`
+	Completed int          `json:"completed"`
+	Aborted   int          `json:"aborted"`
+	Canceled  int          `json:"canceled"`
+	Measured  int          `json:"measured"`
+	OnTime    float64      `json:"ontime"`
+	Delay     Distribution `json:"delay"`
+	Overrun   Distribution `json:"overrun"`
+}
+
+type Timings []*Timing
+
+// EventTimings computes, per category and source, the timing statistics of
+// the events planned between f and t. An event is on time when it starts
+// within tolerance of its planned start.
+func EventTimings(db *sql.DB, f, t time.Time, tolerance time.Duration) (Timings, error) {
+	if f.IsZero() && t.IsZero() {
+		t = time.Now()
+		f = t.AddDate(0, 0, -30)
+	}
+	if tolerance <= 0 {
+		tolerance = OnTime
+	}
+	const q = `
+		with es(category, source, state, delay, overrun) as (
+			select
+				coalesce(c.name, ''),
+				coalesce(e.source, ''),
+				case when e.canceled then 'canceled' else e.state::text end,
+				case when not e.canceled and e.state is distinct from 'canceled' then extract(epoch from e.rtstart-e.dtstart) end,
+				case when not e.canceled and e.state is distinct from 'canceled' then extract(epoch from (e.rtend-e.rtstart)-(e.dtend-e.dtstart)) end
+			from schedule.events e
+				left outer join schedule.events_categories x on e.pk=x.event
+				left outer join schedule.categories c on x.category=c.pk
+			where
+				e.dtstart>=$1 and e.dtstart<$2
+		)
+		select
+			category,
+			source,
+			count(*),
+			count(*) filter (where state='completed'),
+			count(*) filter (where state='aborted'),
+			count(*) filter (where state='canceled'),
+			count(delay),
+			count(*) filter (where abs(delay)<=$3),
+			coalesce(min(delay), 0),
+			coalesce(max(delay), 0),
+			coalesce(avg(delay), 0),
+			coalesce(percentile_cont(0.5) within group (order by delay), 0),
+			coalesce(percentile_cont(0.9) within group (order by delay), 0),
+			coalesce(min(overrun), 0),
+			coalesce(max(overrun), 0),
+			coalesce(avg(overrun), 0),
+			coalesce(percentile_cont(0.5) within group (order by overrun), 0),
+			coalesce(percentile_cont(0.9) within group (order by overrun), 0)
+		from es
+		group by category, source
+		order by category, source`
+	rs, err := db.Query(q, f.UTC(), t.UTC(), tolerance.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	var ts Timings
+	for rs.Next() {
+		var (
+			t      Timing
+			ontime int
+		)
+		err := rs.Scan(
+			&t.Category,
+			&t.Source,
+			&t.Count,
+			&t.Completed,
+			&t.Aborted,
+			&t.Canceled,
+			&t.Measured,
+			&ontime,
+			&t.Delay.Min,
+			&t.Delay.Max,
+			&t.Delay.Mean,
+			&t.Delay.Median,
+			&t.Delay.P90,
+			&t.Overrun.Min,
+			&t.Overrun.Max,
+			&t.Overrun.Mean,
+			&t.Overrun.Median,
+			&t.Overrun.P90,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if t.Measured > 0 {
+			t.OnTime = float64(ontime*100) / float64(t.Measured)
+		}
+		ts = append(ts, &t)
+	}
+	return ts, rs.Err()
+}
+
+func (ts Timings) Header() []string {
+	return []string{
+		"category",
+		"source",
+		"count",
+		"completed",
+		"aborted",
+		"canceled",
+		"measured",
+		"ontime",
+		"delay_min",
+		"delay_max",
+		"delay_mean",
+		"delay_median",
+		"delay_p90",
+		"overrun_min",
+		"overrun_max",
+		"overrun_mean",
+		"overrun_median",
+		"overrun_p90",
+	}
+}
+
+func (ts Timings) Rows() [][]string {
+	vs := make([][]string, 0, len(ts))
+	for _, t := range ts {
+		r := []string{
+			t.Category,
+			t.Source,
+			strconv.Itoa(t.Count),
+			strconv.Itoa(t.Completed),
+			strconv.Itoa(t.Aborted),
+			strconv.Itoa(t.Canceled),
+			strconv.Itoa(t.Measured),
+			formatFloat(t.OnTime),
+		}
+		r = append(r, t.Delay.strings()...)
+		r = append(r, t.Overrun.strings()...)
+		vs = append(vs, r)
+	}
+	return vs
+}
+
+func (d Distribution) strings() []string {
+	return []string{
+		formatFloat(d.Min),
+		formatFloat(d.Max),
+		formatFloat(d.Mean),
+		formatFloat(d.Median),
+		formatFloat(d.P90),
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
+
+const (
+	GroupByCategory = "category"
+	GroupByOperator = "operator"
+	GroupByWeek     = "week"
+)
+
+var uplinkGroups = map[string]string{
+	GroupByCategory: "c.name",
+	GroupByOperator: "p.initial",
+	GroupByWeek:     `to_char(date_trunc('week', coalesce(e.rtstart, e.dtstart)), 'IYYY-"W"IW')`,
+}
+
+// UplinkStat gives the key performance indicators of the uplinks and
+// downlinks of a group. Rates are given in percent, durations in seconds:
+// Preparation is the mean time from the creation of the file to the completion
+// of the uplink and Latency the mean time from the completion of an uplink to
+// the completion of its transfers. Completions are the recorded actual ends
+// (rtend) of the uplink and transfer events; the ones not recorded are left
+// out.
+type UplinkStat struct {
+	Group       string  `json:"group"`
+	Uplinks     int     `json:"uplinks"`
+	Downlinks   int     `json:"downlinks"`
+	Completed   int     `json:"completed"`
+	Aborted     int     `json:"aborted"`
+	Success     float64 `json:"success"`
+	Abort       float64 `json:"abort"`
+	Preparation float64 `json:"preparation"`
+	Latency     float64 `json:"latency"`
+}
+
+// UplinkGroups is the result of UplinkStats, one UplinkStat per group.
+type UplinkGroups []*UplinkStat
+
+// UplinkStats computes the statistics of the uplinks and downlinks executed
+// between from and to, grouped by slot category, operator or week.
+func UplinkStats(db *sql.DB, from, to time.Time, groupBy string) (UplinkGroups, error) {
+	g, ok := uplinkGroups[groupBy]
+	if !ok {
+		return nil, Error{
+			Severity: SeverityError,
+			Source:   "stats",
+			Field:    "groupby",
+			Code:     CodeInvalid,
+			Message:  fmt.Sprintf("can not group uplinks by %q", groupBy),
+		}
+	}
+	if from.IsZero() && to.IsZero() {
+		to = time.Now()
+		from = to.AddDate(0, -1, 0)
+	}
+	q := fmt.Sprintf(`
+		with us(grp, pk, state, dummy, preparation, latency) as (
+			select
+				%s,
+				u.pk,
+				u.state,
+				f.length=0,
+				case when u.state='completed' then extract(epoch from e.rtend-coalesce((select min(r.lastmod) from revisions.files r where r.pk=f.pk), f.lastmod)) end,
+				(select avg(extract(epoch from x.rtend-e.rtend)) from schedule.transfers t join schedule.events x on t.event=x.pk where t.uplink=u.pk and t.state='completed' and u.state='completed')
+			from schedule.uplinks u
+				join schedule.events e on u.event=e.pk
+				join schedule.files f on u.file=f.pk
+				join schedule.slots s on u.slot=s.pk
+				join schedule.categories c on s.category=c.pk
+				join usoc.persons p on u.person=p.pk
+			where
+				coalesce(e.rtstart, e.dtstart) between $1 and $2
+		)
+		select
+			grp,
+			count(*) filter (where not dummy),
+			count(*) filter (where dummy),
+			count(*) filter (where state='completed'),
+			count(*) filter (where state='aborted'),
+			coalesce(avg(preparation) filter (where not dummy), 0),
+			coalesce(avg(latency), 0)
+		from us
+		group by grp
+		order by grp`, g)
+	rs, err := db.Query(q, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	var ss UplinkGroups
+	for rs.Next() {
+		var s UplinkStat
+		if err := rs.Scan(&s.Group, &s.Uplinks, &s.Downlinks, &s.Completed, &s.Aborted, &s.Preparation, &s.Latency); err != nil {
+			return nil, err
+		}
+		if n := s.Uplinks + s.Downlinks; n > 0 {
+			s.Success = float64(s.Completed*100) / float64(n)
+			s.Abort = float64(s.Aborted*100) / float64(n)
+		}
+		ss = append(ss, &s)
+	}
+	return ss, rs.Err()
+}
+
+func (ss UplinkGroups) Header() []string {
+	return []string{"group", "uplinks", "downlinks", "completed", "aborted", "success", "abort", "preparation", "latency"}
+}
+
+func (ss UplinkGroups) Rows() [][]string {
+	vs := make([][]string, 0, len(ss))
+	for _, s := range ss {
+		r := []string{
+			s.Group,
+			strconv.Itoa(s.Uplinks),
+			strconv.Itoa(s.Downlinks),
+			strconv.Itoa(s.Completed),
+			strconv.Itoa(s.Aborted),
+			formatFloat(s.Success),
+			formatFloat(s.Abort),
+			formatFloat(s.Preparation),
+			formatFloat(s.Latency),
+		}
+		vs = append(vs, r)
+	}
+	return vs
+}
@@ -0,0 +1,134 @@
+package hourglass
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"sort"
+	"sync"
+)
+
+const (
+	CRC16   = "crc16-ccitt"
+	CRC32   = "crc32"
+	Adler32 = "adler32"
+	SHA256  = "sha256"
+	MD5     = "md5"
+)
+
+var registry = struct {
+	sync.RWMutex
+	hashes map[string]func() hash.Hash
+}{
+	hashes: map[string]func() hash.Hash{
+		CRC16:   func() hash.Hash { return newCRC16() },
+		CRC32:   func() hash.Hash { return crc32.NewIEEE() },
+		Adler32: func() hash.Hash { return adler32.New() },
+		SHA256:  sha256.New,
+		MD5:     md5.New,
+	},
+}
+
+// RegisterChecksum makes a checksum algorithm available under the given name.
+// Every registered algorithm is computed for the files created afterwards.
+func RegisterChecksum(name string, fn func() hash.Hash) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.hashes[name] = fn
+}
+
+// Checksums gives the names of the registered checksum algorithms.
+func Checksums() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	vs := make([]string, 0, len(registry.hashes))
+	for n := range registry.hashes {
+		vs = append(vs, n)
+	}
+	sort.Strings(vs)
+	return vs
+}
+
+func checkChecksum(name string) error {
+	registry.RLock()
+	defer registry.RUnlock()
+	if _, ok := registry.hashes[name]; name != "" && !ok {
+		return unknownChecksum(name)
+	}
+	return nil
+}
+
+// newChecksum gives a new hash for the given checksum algorithm.
+func newChecksum(name string) (hash.Hash, error) {
+	registry.RLock()
+	fn, ok := registry.hashes[name]
+	registry.RUnlock()
+	if !ok {
+		return nil, unknownChecksum(name)
+	}
+	return fn(), nil
+}
+
+func unknownChecksum(name string) error {
+	return Error{
+		Severity: SeverityError,
+		Source:   "categories",
+		Field:    "checksum",
+		Code:     CodeInvalid,
+		Message:  fmt.Sprintf("%s: unknown checksum algorithm", name),
+	}
+}
+
+// newChecksums gives a new hash for every registered checksum.
+func newChecksums() map[string]hash.Hash {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	hs := make(map[string]hash.Hash, len(registry.hashes))
+	for n, fn := range registry.hashes {
+		hs[n] = fn()
+	}
+	return hs
+}
+
+// sumChecksums gives the hex encoded value of the hashes given by
+// newChecksums.
+func sumChecksums(hs map[string]hash.Hash) map[string]string {
+	vs := make(map[string]string, len(hs))
+	for n, h := range hs {
+		vs[n] = hex.EncodeToString(h.Sum(nil))
+	}
+	return vs
+}
+
+// crc16 is the CRC-16/CCITT-FALSE expected by the MMU.
+type crc16 struct {
+	v uint16
+}
+
+func newCRC16() *crc16 {
+	return &crc16{v: CITT}
+}
+
+func (c *crc16) Write(bs []byte) (int, error) {
+	for _, b := range bs {
+		x := (c.v >> 8) ^ uint16(b)
+		x ^= x >> 4
+		c.v = (c.v << 8) ^ (x << 12) ^ (x << 5) ^ x
+	}
+	return len(bs), nil
+}
+
+func (c *crc16) Sum(bs []byte) []byte {
+	return append(bs, byte(c.v>>8), byte(c.v))
+}
+
+func (c *crc16) Sum16() uint16  { return c.v }
+func (c *crc16) Reset()         { c.v = CITT }
+func (c *crc16) Size() int      { return 2 }
+func (c *crc16) BlockSize() int { return 1 }
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Table is implemented by the results that give their own CSV layout.
+type Table interface {
+	Header() []string
+	Rows() [][]string
+}
+
+// csvSep separates the values of arrays and metadata within a single cell.
+const csvSep = ";"
+
+// acceptCSV tells if the client asked for CSV, either with the format query
+// parameter (csv or excel) or with the Accept header. The second value is
+// false if JSON should be written.
+func acceptCSV(r *http.Request) (string, bool) {
+	switch f := r.URL.Query().Get("format"); f {
+	case "csv", "excel":
+		return f, true
+	case "":
+		return "csv", strings.Contains(r.Header.Get("Accept"), "text/csv")
+	default:
+		return "", false
+	}
+}
+
+// stream is a list read one item at a time while it is written as CSV: walk
+// calls fn with every item, typ is the struct type of the items.
+type stream struct {
+	typ  reflect.Type
+	walk func(fn func(interface{}) error) error
+}
+
+// empty is an empty list: it is written as a 204 in JSON but as the header row
+// in CSV.
+type empty struct {
+	list interface{}
+}
+
+// csvable tells if d can be written as CSV: only Table, stream and slices of
+// structs can, the other results are written as JSON.
+func csvable(d interface{}) bool {
+	switch d := d.(type) {
+	case Table, stream:
+		return true
+	case empty:
+		return csvable(d.list)
+	}
+	v := reflect.ValueOf(d)
+	return v.Kind() == reflect.Slice && elemStruct(v.Type().Elem()) != nil
+}
+
+// writeCSV writes d as CSV with the given status. Table gives its own rows,
+// streams and slices of structs get one column per field (see columnsOf) and
+// are written one row at a time. With excel, the output starts with a byte
+// order mark and uses CRLF so that the spreadsheets detect the encoding, and
+// the cells that could be taken as formulas are escaped (see escapeCell).
+//
+// Nothing is written if a stream fails before its first item so that the
+// error can still be reported; later errors are only logged.
+func writeCSV(w http.ResponseWriter, d interface{}, excel bool, status int) error {
+	if !csvable(d) {
+		return fmt.Errorf("csv not supported for %T", d)
+	}
+	if e, ok := d.(empty); ok {
+		d = e.list
+	}
+	var ws *csv.Writer
+	start := func() {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		if excel {
+			w.Header().Set("Content-Disposition", "attachment")
+		}
+		w.WriteHeader(status)
+		if excel {
+			w.Write([]byte("\xEF\xBB\xBF"))
+		}
+		ws = csv.NewWriter(w)
+		ws.UseCRLF = excel
+	}
+	switch d := d.(type) {
+	case Table:
+		start()
+		ws.Write(d.Header())
+		for _, row := range d.Rows() {
+			if excel {
+				escapeRow(row)
+			}
+			ws.Write(row)
+		}
+	case stream:
+		var rw *recordWriter
+		err := d.walk(func(v interface{}) error {
+			if rw == nil {
+				start()
+				rw = newRecordWriter(ws, w, d.typ, excel)
+			}
+			return rw.Write(reflect.ValueOf(v))
+		})
+		if err != nil && rw == nil {
+			return err
+		}
+		if err != nil {
+			log.Println(err)
+		}
+		if rw == nil {
+			start()
+			newRecordWriter(ws, w, d.typ, excel)
+		}
+	default:
+		start()
+		v := reflect.ValueOf(d)
+		rw := newRecordWriter(ws, w, elemStruct(v.Type().Elem()), excel)
+		for i := 0; i < v.Len(); i++ {
+			if err := rw.Write(v.Index(i)); err != nil {
+				break
+			}
+		}
+	}
+	ws.Flush()
+	if err := ws.Error(); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+// recordWriter writes the records of a struct type, flushing the output every
+// flushEvery records.
+type recordWriter struct {
+	ws    *csv.Writer
+	w     http.ResponseWriter
+	cs    []column
+	row   []string
+	excel bool
+	count int
+}
+
+const flushEvery = 100
+
+func newRecordWriter(ws *csv.Writer, w http.ResponseWriter, t reflect.Type, excel bool) *recordWriter {
+	rw := recordWriter{
+		ws:    ws,
+		w:     w,
+		cs:    columnsOf(t),
+		excel: excel,
+	}
+	rw.row = make([]string, len(rw.cs))
+	for i, c := range rw.cs {
+		rw.row[i] = c.Name
+	}
+	ws.Write(rw.row)
+	return &rw
+}
+
+func (rw *recordWriter) Write(v reflect.Value) error {
+	e := reflect.Indirect(v)
+	if !e.IsValid() {
+		return nil
+	}
+	for j, c := range rw.cs {
+		rw.row[j] = c.Format(e.FieldByIndex(c.Index))
+	}
+	if rw.excel {
+		escapeRow(rw.row)
+	}
+	if err := rw.ws.Write(rw.row); err != nil {
+		return err
+	}
+	if rw.count++; rw.count%flushEvery == 0 {
+		rw.ws.Flush()
+		if f, ok := rw.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	return nil
+}
+
+func escapeRow(row []string) {
+	for i := range row {
+		row[i] = escapeCell(row[i])
+	}
+}
+
+// escapeCell prefixes with a quote the cells that a spreadsheet would evaluate
+// as a formula (starting with =, +, -, @, tab or carriage return). Numbers are
+// left as is.
+func escapeCell(s string) string {
+	if s == "" || !strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return s
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return s
+	}
+	return "'" + s
+}
+
+type column struct {
+	Name   string
+	Index  []int
+	Format func(reflect.Value) string
+}
+
+var columnsCache sync.Map
+
+// columnsOf gives the CSV columns of a struct: one per exported field named
+// after its json tag. Arrays and metadata are flattened in a single cell
+// (values and sorted key=value pairs separated by csvSep), referenced structs
+// are given by their id and nested structs are expanded as "name.field"
+// columns. Lists of structs (history, children,...) are only available in
+// JSON and are left out.
+func columnsOf(t reflect.Type) []column {
+	if cs, ok := columnsCache.Load(t); ok {
+		return cs.([]column)
+	}
+	cs := appendColumns(nil, t, nil, "")
+	columnsCache.Store(t, cs)
+	return cs
+}
+
+func appendColumns(cs []column, t reflect.Type, index []int, prefix string) []column {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		name = prefix + name
+		ix := append(append([]int{}, index...), i)
+
+		if f.Type.Kind() == reflect.Struct && f.Type != timeType {
+			cs = appendColumns(cs, f.Type, ix, name+".")
+			continue
+		}
+		if fn := formatterOf(f.Type); fn != nil {
+			cs = append(cs, column{Name: name, Index: ix, Format: fn})
+		}
+	}
+	return cs
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func formatterOf(t reflect.Type) func(reflect.Value) string {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return formatScalar
+	case reflect.Struct:
+		if t == timeType {
+			return formatTime
+		}
+	case reflect.Ptr:
+		if s := elemStruct(t); s != nil {
+			if f, ok := s.FieldByName("Id"); ok && f.Type.Kind() == reflect.Int {
+				return formatRef
+			}
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 || elemStruct(t.Elem()) != nil {
+			return nil
+		}
+		return formatSlice
+	case reflect.Map:
+		return formatMap
+	}
+	return nil
+}
+
+// elemStruct gives the struct type of t or of the type t points to.
+func elemStruct(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
+
+func formatScalar(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	default:
+		return formatValue(v.Interface())
+	}
+}
+
+func formatTime(v reflect.Value) string {
+	t := v.Interface().(time.Time)
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func formatRef(v reflect.Value) string {
+	if v.IsNil() {
+		return ""
+	}
+	id := v.Elem().FieldByName("Id").Int()
+	if id == 0 {
+		return ""
+	}
+	return strconv.FormatInt(id, 10)
+}
+
+func formatSlice(v reflect.Value) string {
+	vs := make([]string, v.Len())
+	for i := range vs {
+		vs[i] = formatValue(v.Index(i).Interface())
+	}
+	return strings.Join(vs, csvSep)
+}
+
+func formatMap(v reflect.Value) string {
+	vs := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		vs = append(vs, fmt.Sprintf("%v=%s", k.Interface(), formatValue(v.MapIndex(k).Interface())))
+	}
+	sort.Strings(vs)
+	return strings.Join(vs, csvSep)
+}
+
+// formatValue formats the values found in arrays and metadata. Values that
+// are not scalars are written as JSON.
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool, int, int64, float64:
+		return fmt.Sprint(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	default:
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(bs)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"reflect"
 	"strconv"
 	"time"
 
@@ -29,17 +30,33 @@ func listEvents(r *http.Request) (interface{}, error) {
 		}
 	}
 
-	ds, err := hourglass.ListEvents(db, fd, td, q["category[]"], q["source[]"])
+	cs, err := categories(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := acceptCSV(r); ok {
+		return streamEvents(fd, td, cs, q["source[]"]), nil
+	}
+	ds, err := hourglass.ListEvents(db, fd, td, cs, q["source[]"])
 	switch {
 	case err != nil:
 		return ds, err
 	case len(ds) == 0:
-		return nil, err
+		return empty{ds}, err
 	default:
 		return ds, err
 	}
 }
 
+func streamEvents(fd, td time.Time, cs, vs []string) stream {
+	walk := func(fn func(interface{}) error) error {
+		return hourglass.WalkEvents(db, fd, td, cs, vs, func(e *hourglass.Event) error {
+			return fn(e)
+		})
+	}
+	return stream{typ: reflect.TypeOf(hourglass.Event{}), walk: walk}
+}
+
 func importEvents(r *http.Request) (interface{}, error) {
 	v := struct {
 		Source string             `json:"source"`
@@ -87,8 +104,6 @@ func updateEvent(r *http.Request) (interface{}, error) {
 		State:       s.State,
 		Starts:      s.Starts,
 		Ends:        s.Ends,
-		ExStarts:    s.ExStarts,
-		ExEnds:      s.ExEnds,
 		Meta:        s.Meta,
 	}
 	if err := json.NewDecoder(io.LimitReader(r.Body, MaxBodySize)).Decode(e); err != nil {
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"path/filepath"
 	"strconv"
 
 	"github.com/busoc/hourglass"
@@ -12,12 +17,16 @@ import (
 
 func listFiles(r *http.Request) (interface{}, error) {
 	q := r.URL.Query()
-	ds, err := hourglass.ListFiles(db, q.Get("status"), q["category[]"])
+	cs, err := categories(r)
+	if err != nil {
+		return nil, err
+	}
+	ds, err := hourglass.ListFiles(db, q.Get("status"), cs)
 	switch {
 	case err != nil:
 		return ds, err
 	case len(ds) == 0:
-		return nil, err
+		return empty{ds}, err
 	default:
 		return ds, err
 	}
@@ -25,20 +34,140 @@ func listFiles(r *http.Request) (interface{}, error) {
 
 func viewFile(r *http.Request) (interface{}, error) {
 	id, _ := strconv.Atoi(mux.Vars(r)["id"])
-	return hourglass.ViewFile(db, id, true, true)
+	raw, _ := strconv.ParseBool(r.URL.Query().Get("raw"))
+	return hourglass.ViewFile(db, id, raw, true)
+}
+
+func diffFile(r *http.Request) (interface{}, error) {
+	vs := mux.Vars(r)
+	id, _ := strconv.Atoi(vs["id"])
+	other, _ := strconv.Atoi(vs["other"])
+	return hourglass.DiffFiles(db, id, other)
+}
+
+func viewLineage(r *http.Request) (interface{}, error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	return hourglass.ViewLineage(db, id)
 }
 
+func downloadFile(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	f, rs, err := hourglass.OpenFile(db, id)
+	if err != nil {
+		problem(w, err)
+		return
+	}
+	defer rs.Close()
+
+	ctype := mime.TypeByExtension(filepath.Ext(f.Name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": f.Name}))
+	if f.Sum != "" {
+		w.Header().Set("ETag", strconv.Quote(f.Sum))
+	}
+	http.ServeContent(w, r, f.Name, f.Lastmod, rs)
+}
+
+// newFile accepts the file as JSON (content base64 encoded in raw), as a
+// multipart form (content in a file part, other properties in form fields) or
+// as the raw content (other properties given in the query string).
 func newFile(r *http.Request) (interface{}, error) {
-	f := new(hourglass.File)
-	if err := json.NewDecoder(io.LimitReader(r.Body, MaxBodySize)).Decode(f); err != nil {
+	var (
+		f   = new(hourglass.File)
+		err error
+	)
+	switch t, ps, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t {
+	case "multipart/form-data":
+		err = decodeMultipartFile(multipart.NewReader(r.Body, ps["boundary"]), f)
+	case "application/octet-stream":
+		err = decodeRawFile(r, f)
+	default:
+		err = json.NewDecoder(io.LimitReader(r.Body, MaxFileSize)).Decode(f)
+	}
+	if err != nil {
+		f.Release()
 		return nil, err
 	}
+	defer f.Release()
+
 	f.Id, _ = strconv.Atoi(mux.Vars(r)["id"])
 	f.User = r.Context().Value("user").(string)
 	if err := hourglass.NewFile(db, f); err != nil {
 		return nil, err
 	}
-	return hourglass.ViewFile(db, f.Id, true, true)
+	v, err := hourglass.ViewFile(db, f.Id, false, true)
+	if err == nil {
+		v.Warnings = f.Warnings
+	}
+	return v, err
+}
+
+func decodeMultipartFile(mr *multipart.Reader, f *hourglass.File) error {
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if p.FileName() != "" {
+			if f.Name == "" {
+				f.Name = filepath.Base(p.FileName())
+			}
+			err = spoolContent(p, f)
+		} else {
+			err = decodeFileField(p, f)
+		}
+		p.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeFileField(p *multipart.Part, f *hourglass.File) error {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(p, MaxBodySize)); err != nil {
+		return err
+	}
+	switch p.FormName() {
+	case "name":
+		f.Name = buf.String()
+	case "summary":
+		f.Summary = buf.String()
+	case "category[]", "categories":
+		f.Categories = append(f.Categories, buf.String())
+	case "metadata":
+		return json.Unmarshal(buf.Bytes(), &f.Meta)
+	}
+	return nil
+}
+
+func decodeRawFile(r *http.Request, f *hourglass.File) error {
+	q := r.URL.Query()
+	f.Name, f.Summary, f.Categories = q.Get("name"), q.Get("summary"), q["category[]"]
+	if f.Name == "" {
+		_, ps, err := mime.ParseMediaType(r.Header.Get("Content-Disposition"))
+		if n := ps["filename"]; err == nil && n != "" {
+			f.Name = filepath.Base(n)
+		}
+	}
+	return spoolContent(r.Body, f)
+}
+
+// spoolContent copies the content of f to a temporary file instead of keeping
+// it in memory (see File.ReadFrom).
+func spoolContent(r io.Reader, f *hourglass.File) error {
+	n, err := f.ReadFrom(io.LimitReader(r, MaxFileSize+1))
+	if err == nil && n > MaxFileSize {
+		err = fmt.Errorf("file too large (max %d bytes)", MaxFileSize)
+	}
+	return err
 }
 
 func updateFile(r *http.Request) (interface{}, error) {
@@ -61,7 +190,7 @@ func updateFile(r *http.Request) (interface{}, error) {
 	if err := hourglass.UpdateFile(db, f); err != nil {
 		return nil, err
 	}
-	return hourglass.ViewFile(db, f.Id, true, true)
+	return hourglass.ViewFile(db, f.Id, false, true)
 }
 
 func deleteFile(r *http.Request) (interface{}, error) {
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/busoc/hourglass"
+)
+
+// importable lists, per kind of items, the columns accepted by the CSV
+// importers. The columns are named after the json fields of the items.
+var importable = map[string][]string{
+	"events": {"summary", "description", "source", "dtstart", "dtend", "categories", "attendees", "metadata"},
+	"todos":  {"summary", "description", "status", "priority", "due", "dtstart", "dtend", "categories", "assignees", "parent", "metadata"},
+	"files":  {"name", "summary", "categories", "metadata"},
+}
+
+const manifestName = "manifest"
+
+// importEventRows imports a CSV table (or a JSON array) of events. See
+// decodeRows for the layout of the table.
+func importEventRows(r *http.Request) (interface{}, error) {
+	var b hourglass.Batch
+	if err := decodeBatch(r, "events", &b.Events); err != nil {
+		return nil, err
+	}
+	return importBatch(r, &b)
+}
+
+// importTodoRows imports a CSV table (or a JSON array) of todos.
+func importTodoRows(r *http.Request) (interface{}, error) {
+	var b hourglass.Batch
+	if err := decodeBatch(r, "todos", &b.Todos); err != nil {
+		return nil, err
+	}
+	return importBatch(r, &b)
+}
+
+// importArchive imports the files of a zip archive. The archive should have a
+// manifest (manifest.csv or manifest.json) giving the name, summary and
+// categories of every file; each name being the path of the file in the
+// archive.
+func importArchive(r *http.Request) (interface{}, error) {
+	a, n, err := spoolArchive(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		a.Close()
+		os.Remove(a.Name())
+	}()
+	z, err := zip.NewReader(a, n)
+	if err != nil {
+		return nil, err
+	}
+	if len(z.File) > MaxArchiveFiles {
+		return nil, fmt.Errorf("archive has too many files (max %d)", MaxArchiveFiles)
+	}
+	var (
+		b    hourglass.Batch
+		zs   = make(map[string]*zip.File)
+		size uint64
+	)
+	for _, f := range z.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if size += f.UncompressedSize64; size > MaxArchiveSize {
+			return nil, fmt.Errorf("archive too large (max %d bytes uncompressed)", MaxArchiveSize)
+		}
+		switch f.Name {
+		case manifestName + ".csv", manifestName + ".json":
+			if b.Files != nil {
+				return nil, fmt.Errorf("archive has more than one manifest")
+			}
+			if b.Files, err = decodeManifest(f); err != nil {
+				return nil, err
+			}
+			if b.Files == nil {
+				b.Files = []*hourglass.File{}
+			}
+		default:
+			zs[f.Name] = f
+		}
+	}
+	if b.Files == nil {
+		return nil, fmt.Errorf("archive has no manifest")
+	}
+	defer func() {
+		for _, f := range b.Files {
+			f.Release()
+		}
+	}()
+	var (
+		es     hourglass.Errors
+		listed = make(map[string]struct{})
+		left   = int64(MaxArchiveSize)
+	)
+	for i, f := range b.Files {
+		z, ok := zs[f.Name]
+		if !ok {
+			es = append(es, rowError("files", i+1, "name", hourglass.CodeReference, "%s not found in archive", f.Name))
+			continue
+		}
+		listed[f.Name] = struct{}{}
+		n, err := spoolZipFile(z, f, left)
+		if err != nil {
+			return nil, err
+		}
+		left -= n
+		f.Name = path.Base(f.Name)
+	}
+	for n := range zs {
+		if _, ok := listed[n]; !ok {
+			es = append(es, rowError("files", 0, "name", hourglass.CodeInvalid, "%s not listed in manifest", n))
+		}
+	}
+	if len(es) > 0 {
+		return nil, es
+	}
+	return importBatch(r, &b)
+}
+
+func importBatch(r *http.Request, b *hourglass.Batch) (interface{}, error) {
+	preview, _ := strconv.ParseBool(r.URL.Query().Get("preview"))
+	u := r.Context().Value("user").(string)
+	if err := hourglass.ImportBatch(db, b, u, preview); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func decodeBatch(r *http.Request, kind string, v interface{}) error {
+	body := limitBody(r.Body, MaxBodySize)
+	switch t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t {
+	case "text/csv":
+		return decodeRows(body, kind, mappingOf(r), v)
+	default:
+		return json.NewDecoder(body).Decode(v)
+	}
+}
+
+func decodeManifest(f *zip.File) ([]*hourglass.File, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var fs []*hourglass.File
+	if path.Ext(f.Name) == ".json" {
+		err = json.NewDecoder(limitBody(rc, MaxBodySize)).Decode(&fs)
+	} else {
+		err = decodeRows(limitBody(rc, MaxBodySize), "files", nil, &fs)
+	}
+	return fs, err
+}
+
+// spoolArchive copies the archive in r to a temporary file. It fails if the
+// archive is larger than MaxFileSize.
+func spoolArchive(r io.Reader) (*os.File, int64, error) {
+	f, err := os.CreateTemp("", "hourglass-")
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, MaxFileSize+1))
+	if err == nil && n > MaxFileSize {
+		err = fmt.Errorf("archive too large (max %d bytes)", MaxFileSize)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, err
+	}
+	return f, n, nil
+}
+
+// spoolZipFile reads the content of z into f. It fails if z is larger than
+// MaxFileSize or than the part of MaxArchiveSize not yet read (left).
+func spoolZipFile(z *zip.File, f *hourglass.File, left int64) (int64, error) {
+	rc, err := z.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	if left > MaxFileSize {
+		left = MaxFileSize
+	}
+	n, err := f.ReadFrom(io.LimitReader(rc, left+1))
+	if err == nil && n > left {
+		err = fmt.Errorf("%s: file or archive too large", z.Name)
+	}
+	return n, err
+}
+
+// limitBody reads at most n bytes from r. Unlike io.LimitReader, it fails
+// when r has more instead of stopping silently.
+func limitBody(r io.Reader, n int64) io.Reader {
+	return &limitedReader{r: io.LimitReader(r, n+1), max: n}
+}
+
+type limitedReader struct {
+	r    io.Reader
+	read int64
+	max  int64
+}
+
+func (r *limitedReader) Read(bs []byte) (int, error) {
+	n, err := r.r.Read(bs)
+	if r.read += int64(n); r.read > r.max {
+		return n, fmt.Errorf("body too large (max %d bytes)", r.max)
+	}
+	return n, err
+}
+
+// mappingOf gives the column mapping given in the query string as
+// map=<column>:<field> parameters.
+func mappingOf(r *http.Request) map[string]string {
+	m := make(map[string]string)
+	for _, v := range r.URL.Query()["map"] {
+		if i := strings.IndexByte(v, ':'); i > 0 {
+			m[strings.ToLower(strings.TrimSpace(v[:i]))] = strings.TrimSpace(v[i+1:])
+		}
+	}
+	return m
+}
+
+// decodeRows decodes a CSV table into v, a pointer to a slice of pointers to
+// struct. The first line gives the columns, named after the json fields of
+// the items (or renamed with mapping). Values are written as exported by
+// writeCSV: arrays and metadata are separated by semicolons, times are given
+// as RFC3339 or as "2006-01-02 15:04". All the invalid values are reported at
+// once, each one with its row (starting at 1 after the header) as source.
+func decodeRows(r io.Reader, kind string, mapping map[string]string, v interface{}) error {
+	rs := csv.NewReader(r)
+	rs.TrimLeadingSpace = true
+
+	head, err := rs.Read()
+	if err != nil {
+		return err
+	}
+	var (
+		es    hourglass.Errors
+		cs    = make([]*column, len(head))
+		slice = reflect.ValueOf(v).Elem()
+		typ   = slice.Type().Elem().Elem()
+	)
+	for i, h := range head {
+		h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\xEF\xBB\xBF")))
+		if m, ok := mapping[h]; ok {
+			h = m
+		}
+		if cs[i] = importColumn(typ, kind, h); cs[i] == nil {
+			es = append(es, rowError(kind, 0, h, hourglass.CodeInvalid, "unknown column %q", head[i]))
+		}
+	}
+	if len(es) > 0 {
+		return es
+	}
+	for n := 1; ; n++ {
+		row, err := rs.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		x := reflect.New(typ)
+		for i, c := range cs {
+			if err := setValue(x.Elem().FieldByIndex(c.Index), strings.TrimSpace(row[i])); err != nil {
+				es = append(es, rowError(kind, n, c.Name, hourglass.CodeInvalid, "%s: %s", c.Name, err))
+			}
+		}
+		slice.Set(reflect.Append(slice, x))
+	}
+	if len(es) > 0 {
+		return es
+	}
+	return nil
+}
+
+func importColumn(t reflect.Type, kind, name string) *column {
+	var ok bool
+	for _, n := range importable[kind] {
+		if ok = n == name; ok {
+			break
+		}
+	}
+	if !ok {
+		return nil
+	}
+	for _, c := range columnsOf(t) {
+		if c.Name == name {
+			return &c
+		}
+	}
+	return nil
+}
+
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+func setValue(v reflect.Value, s string) error {
+	if s == "" {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		v.SetInt(int64(n))
+	case reflect.Struct:
+		for _, f := range timeLayouts {
+			if t, err := time.Parse(f, s); err == nil {
+				v.Set(reflect.ValueOf(t.UTC()))
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid time %q", s)
+	case reflect.Slice:
+		var vs []string
+		for _, x := range strings.Split(s, csvSep) {
+			if x = strings.TrimSpace(x); x != "" {
+				vs = append(vs, x)
+			}
+		}
+		v.Set(reflect.ValueOf(vs))
+	case reflect.Map:
+		m := make(map[string]interface{})
+		if strings.HasPrefix(s, "{") {
+			if err := json.Unmarshal([]byte(s), &m); err != nil {
+				return fmt.Errorf("invalid metadata")
+			}
+		} else {
+			for _, x := range strings.Split(s, csvSep) {
+				i := strings.IndexByte(x, '=')
+				if i <= 0 {
+					return fmt.Errorf("invalid metadata %q (key=value expected)", x)
+				}
+				var val interface{}
+				if err := json.Unmarshal([]byte(x[i+1:]), &val); err != nil {
+					val = x[i+1:]
+				}
+				m[strings.TrimSpace(x[:i])] = val
+			}
+		}
+		v.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("can not be imported")
+	}
+	return nil
+}
+
+func rowError(kind string, row int, field, code, msg string, args ...interface{}) hourglass.Error {
+	return hourglass.Error{
+		Severity: hourglass.SeverityError,
+		Source:   fmt.Sprintf("%s:%d", kind, row),
+		Field:    field,
+		Code:     code,
+		Message:  fmt.Sprintf(msg, args...),
+	}
+}
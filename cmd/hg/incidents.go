@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/busoc/hourglass"
+	"github.com/gorilla/mux"
+)
+
+func listIncidents(r *http.Request) (interface{}, error) {
+	var fd, td time.Time
+	q := r.URL.Query()
+	if q.Get("dtstart") != "" || q.Get("dtend") != "" {
+		var err error
+		if fd, err = time.Parse(time.RFC3339, q.Get("dtstart")); err != nil {
+			return nil, fmt.Errorf("dtstart bad format")
+		}
+		if td, err = time.Parse(time.RFC3339, q.Get("dtend")); err != nil {
+			return nil, fmt.Errorf("dtend bad format")
+		}
+	}
+
+	cs, err := categories(r)
+	if err != nil {
+		return nil, err
+	}
+	ds, err := hourglass.ListIncidents(db, fd, td, cs, q["status[]"], q["severity[]"])
+	switch {
+	case err != nil:
+		return ds, err
+	case len(ds) == 0:
+		return empty{ds}, err
+	default:
+		return ds, err
+	}
+}
+
+func viewIncident(r *http.Request) (interface{}, error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	return hourglass.ViewIncident(db, id)
+}
+
+func newIncident(r *http.Request) (interface{}, error) {
+	var i hourglass.Incident
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxBodySize)).Decode(&i); err != nil {
+		return nil, err
+	}
+	i.User = r.Context().Value("user").(string)
+	if err := hourglass.NewIncident(db, &i); err != nil {
+		return nil, err
+	}
+	return hourglass.ViewIncident(db, i.Id)
+}
+
+func updateIncident(r *http.Request) (interface{}, error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	s, err := hourglass.ViewIncident(db, id)
+	if err != nil {
+		return nil, err
+	}
+	i := hourglass.Incident{
+		Summary:     s.Summary,
+		Description: s.Description,
+		Severity:    s.Severity,
+		State:       s.State,
+		Detected:    s.Detected,
+		Event:       s.Event,
+		Meta:        s.Meta,
+		Categories:  s.Categories,
+		Slots:       s.Slots,
+		Journals:    s.Journals,
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxBodySize)).Decode(&i); err != nil {
+		return nil, err
+	}
+	i.Id = id
+	i.User = r.Context().Value("user").(string)
+	if err := hourglass.UpdateIncident(db, &i); err != nil {
+		return nil, err
+	}
+	return hourglass.ViewIncident(db, i.Id)
+}
+
+func deleteIncident(r *http.Request) (interface{}, error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	i, err := hourglass.ViewIncident(db, id)
+	if err != nil {
+		return nil, err
+	}
+	i.User = r.Context().Value("user").(string)
+	return nil, hourglass.DeleteIncident(db, i)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/busoc/hourglass"
+)
+
+func viewInventory(r *http.Request) (interface{}, error) {
+	at, err := parseInstant(r)
+	if err != nil {
+		return nil, err
+	}
+	return hourglass.Inventory(db, at)
+}
+
+// compareInventory accepts the onboard dump either as a JSON array or as a
+// CSV table with the columns slot, name, crc and an optional checksum (an
+// optional header line is skipped).
+func compareInventory(r *http.Request) (interface{}, error) {
+	at, err := parseInstant(r)
+	if err != nil {
+		return nil, err
+	}
+	var ds []*hourglass.Dump
+
+	body := io.LimitReader(r.Body, MaxBodySize)
+	switch t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t {
+	case "text/csv":
+		ds, err = decodeDump(body)
+	default:
+		err = json.NewDecoder(body).Decode(&ds)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fs, err := hourglass.CompareInventory(db, at, ds)
+	if err == nil && len(fs) == 0 {
+		return empty{fs}, nil
+	}
+	return fs, err
+}
+
+func parseInstant(r *http.Request) (time.Time, error) {
+	var at time.Time
+	if d := r.URL.Query().Get("dtstamp"); d != "" {
+		var err error
+		if at, err = time.Parse(time.RFC3339, d); err != nil {
+			return at, fmt.Errorf("dtstamp bad format")
+		}
+	}
+	return at, nil
+}
+
+func decodeDump(r io.Reader) ([]*hourglass.Dump, error) {
+	rs := csv.NewReader(r)
+	rs.FieldsPerRecord = -1
+	rs.TrimLeadingSpace = true
+
+	var ds []*hourglass.Dump
+	for i := 0; ; i++ {
+		row, err := rs.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(row) < 3 || len(row) > 4 {
+			return nil, fmt.Errorf("line %d: expected 3 or 4 columns, got %d", i+1, len(row))
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(row[0]))
+		if err != nil {
+			if i == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: invalid slot %q", i+1, row[0])
+		}
+		d := &hourglass.Dump{
+			Slot: id,
+			Name: strings.TrimSpace(row[1]),
+		}
+		if len(row) == 4 {
+			d.Checksum = strings.TrimSpace(row[3])
+		}
+		if v := strings.TrimSpace(row[2]); v != "" || d.Checksum == "" {
+			crc, err := strconv.ParseUint(v, 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid crc %q", i+1, row[2])
+			}
+			d.Cyclic = uint16(crc)
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
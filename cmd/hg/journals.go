@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/busoc/hourglass"
@@ -25,17 +29,81 @@ func listJournals(r *http.Request) (interface{}, error) {
 		}
 	}
 
-	ds, err := hourglass.ListJournals(db, fd, td, q["category[]"])
+	cs, err := categories(r)
+	if err != nil {
+		return nil, err
+	}
+	ds, err := hourglass.ListJournals(db, fd, td, cs, q["signoff[]"])
 	switch {
 	case err != nil:
 		return ds, err
 	case len(ds) == 0:
-		return nil, err
+		return empty{ds}, err
 	default:
 		return ds, err
 	}
 }
 
+// reportJournal renders the DOR of the day given in the query string (today
+// by default) as Markdown, HTML or PDF, according to the format parameter or,
+// when not given, the Accept header.
+func reportJournal(w http.ResponseWriter, r *http.Request) {
+	day := time.Now()
+	if v := r.URL.Query().Get("day"); v != "" {
+		d, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			problem(w, hourglass.Error{Severity: hourglass.SeverityError, Source: "dors", Field: "day", Code: hourglass.CodeInvalid, Message: "day bad format"})
+			return
+		}
+		day = d
+	}
+	rp, err := hourglass.BuildReport(db, day)
+	if err != nil {
+		problem(w, err)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		a := r.Header.Get("Accept")
+		switch {
+		case strings.Contains(a, "application/pdf"):
+			format = "pdf"
+		case strings.Contains(a, "text/html"):
+			format = "html"
+		case strings.Contains(a, "application/json"):
+			format = "json"
+		default:
+			format = "md"
+		}
+	}
+	name := "dor_" + rp.Day.Format("20060102")
+	switch format {
+	case "md", "markdown":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		err = rp.Markdown(w)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = rp.HTML(w)
+	case "pdf":
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".pdf"}))
+		var buf bytes.Buffer
+		if err = rp.PDF(&buf); err == nil {
+			_, err = buf.WriteTo(w)
+		}
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(rp)
+	default:
+		problem(w, hourglass.Error{Severity: hourglass.SeverityError, Source: "dors", Field: "format", Code: hourglass.CodeInvalid, Message: fmt.Sprintf("unsupported format %s", format)})
+		return
+	}
+	if err != nil {
+		problem(w, err)
+	}
+}
+
 func viewJournal(r *http.Request) (interface{}, error) {
 	id, _ := strconv.Atoi(mux.Vars(r)["id"])
 	return hourglass.ViewJournal(db, id)
@@ -60,12 +128,14 @@ func updateJournal(r *http.Request) (interface{}, error) {
 		return nil, err
 	}
 	j := hourglass.Journal{
-		Id:         id,
-		Summary:    s.Summary,
-		Day:        s.Day,
-		State:      s.State,
-		Meta:       s.Meta,
-		Categories: s.Categories,
+		Id:          id,
+		Summary:     s.Summary,
+		Day:         s.Day,
+		State:       s.State,
+		Meta:        s.Meta,
+		Categories:  s.Categories,
+		Attachments: s.Attachments,
+		Links:       s.Links,
 	}
 	if err := json.NewDecoder(io.LimitReader(r.Body, MaxBodySize)).Decode(&j); err != nil {
 		return nil, err
@@ -77,6 +147,59 @@ func updateJournal(r *http.Request) (interface{}, error) {
 	return hourglass.ViewJournal(db, j.Id)
 }
 
+func signoffJournal(r *http.Request) (interface{}, error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	v := struct {
+		Signoff string `json:"signoff"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxBodySize)).Decode(&v); err != nil {
+		return nil, err
+	}
+	u := r.Context().Value("user").(string)
+	if err := hourglass.SignoffJournal(db, id, v.Signoff, u); err != nil {
+		return nil, err
+	}
+	return hourglass.ViewJournal(db, id)
+}
+
+func addAddendum(r *http.Request) (interface{}, error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	var a hourglass.Addendum
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxBodySize)).Decode(&a); err != nil {
+		return nil, err
+	}
+	a.User = r.Context().Value("user").(string)
+	if err := hourglass.AddAddendum(db, id, &a); err != nil {
+		return nil, err
+	}
+	return hourglass.ViewJournal(db, id)
+}
+
+// attachFile accepts the attachment in the same forms as newFile.
+func attachFile(r *http.Request) (interface{}, error) {
+	var (
+		f   = new(hourglass.File)
+		err error
+	)
+	switch t, ps, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t {
+	case "multipart/form-data":
+		err = decodeMultipartFile(multipart.NewReader(r.Body, ps["boundary"]), f)
+	case "application/octet-stream":
+		err = decodeRawFile(r, f)
+	default:
+		err = json.NewDecoder(io.LimitReader(r.Body, MaxFileSize)).Decode(f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	f.Id, f.User = 0, r.Context().Value("user").(string)
+	if err := hourglass.AttachFile(db, id, f); err != nil {
+		return nil, err
+	}
+	return hourglass.ViewJournal(db, id)
+}
+
 func deleteJournal(r *http.Request) (interface{}, error) {
 	id, _ := strconv.Atoi(mux.Vars(r)["id"])
 	j, err := hourglass.ViewJournal(db, id)
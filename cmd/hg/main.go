@@ -2,10 +2,13 @@ package main
 
 import (
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -21,7 +24,17 @@ import (
 	"github.com/midbel/rustine"
 )
 
-const MaxBodySize = 1 << 32
+const (
+	// MaxBodySize bounds the JSON and CSV bodies, MaxFileSize the content of
+	// the uploaded files.
+	MaxBodySize = 1 << 22
+	MaxFileSize = 1 << 30
+
+	// MaxArchiveSize and MaxArchiveFiles bound the total uncompressed size
+	// and the number of entries of the imported archives.
+	MaxArchiveSize  = 1 << 32
+	MaxArchiveFiles = 1 << 12
+)
 
 var db *sql.DB
 
@@ -38,11 +51,34 @@ type I struct {
 	Hosts  []string `json:"sources"`
 }
 
+// V describes the validators applied to the files of a category.
+type V struct {
+	Category string   `json:"category"`
+	Size     int      `json:"size"`
+	Names    []string `json:"names"`
+	Rules    string   `json:"rules"`
+	Format   string   `json:"format"`
+}
+
 type Config struct {
 	Addr     string `json:"addr"`
 	Database string `json:"db"`
-	Token    *T     `json:"token"`
-	Import   *I     `json:"import"`
+	Storage  string `json:"storage"`
+	// Sweep is the number of seconds between two removals of the content no
+	// longer referenced from the storage directory (1 hour by default).
+	Sweep      int `json:"sweep"`
+	Token      *T  `json:"token"`
+	Import     *I  `json:"import"`
+	Validators []V `json:"validators"`
+
+	Rollup    *hourglass.TodoRollup `json:"rollup"`
+	Reminders *R                    `json:"reminders"`
+	// Approver is the position whose holders can approve the DORs. DORs can
+	// not be approved when it is not set.
+	Approver string `json:"approver"`
+	// Categories allows the creation of unknown categories when they are
+	// given to events, files, todos, journals or incidents.
+	Categories bool `json:"implicit_categories"`
 }
 
 func init() {
@@ -79,6 +115,35 @@ func main() {
 	}
 	defer db.Close()
 
+	if c.Storage != "" {
+		s, err := hourglass.NewDirStorage(c.Storage)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		hourglass.Store = s
+		go sweepStorage(db, s, c.Sweep)
+	}
+
+	if err := setupValidators(c.Validators); err != nil {
+		log.Fatalln(err)
+	}
+	if c.Rollup != nil {
+		hourglass.Rollup = *c.Rollup
+	}
+
+	if hourglass.ApproverPosition = c.Approver; c.Approver == "" {
+		log.Println("no approver position configured: journals can not be approved")
+	}
+	hourglass.ImplicitCategories = c.Categories
+
+	if c.Reminders != nil {
+		n, err := setupReminders(c.Reminders)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go runReminders(db, c.Reminders, n)
+	}
+
 	r := mux.NewRouter()
 	if err := setupRoutes(r, &c); err != nil {
 		log.Fatalln(err)
@@ -91,6 +156,51 @@ func main() {
 	}
 }
 
+func sweepStorage(db *sql.DB, s *hourglass.DirStorage, interval int) {
+	if interval <= 0 {
+		interval = 3600
+	}
+	t := time.NewTicker(time.Duration(interval) * time.Second)
+	defer t.Stop()
+	for range t.C {
+		n, err := s.Sweep(db)
+		if err != nil {
+			log.Printf("sweep storage: %s", err)
+		}
+		if n > 0 {
+			log.Printf("sweep storage: %d file(s) removed", n)
+		}
+	}
+}
+
+func setupValidators(vs []V) error {
+	for _, v := range vs {
+		if v.Size > 0 {
+			hourglass.RegisterValidator(v.Category, hourglass.MaxSize(v.Size))
+		}
+		if len(v.Names) > 0 {
+			hourglass.RegisterValidator(v.Category, hourglass.AllowNames(v.Names...))
+		}
+		if v.Rules != "" {
+			rs, err := hourglass.LoadRules(v.Rules)
+			if err != nil {
+				return err
+			}
+			hourglass.RegisterValidator(v.Category, rs)
+		}
+		switch strings.ToLower(v.Format) {
+		case "":
+		case "json":
+			hourglass.RegisterValidator(v.Category, hourglass.WellFormedJSON())
+		case "xml":
+			hourglass.RegisterValidator(v.Category, hourglass.WellFormedXML())
+		default:
+			return fmt.Errorf("%s: unsupported format %s", v.Category, v.Format)
+		}
+	}
+	return nil
+}
+
 func setupRoutesBis(r *mux.Router, c *Config) error {
 	c.Import.Prefix = strings.Trim(c.Import.Prefix, "/")
 
@@ -109,11 +219,14 @@ func setupRoutesBis(r *mux.Router, c *Config) error {
 		{Path: "/sources/", Handler: listSources},
 		{Path: "/users/", Handler: listUsers},
 		{Path: "/categories/", Handler: listCategories},
+		{Path: "/categories/tree", Handler: treeCategories},
 		{Path: "/dors/", Handler: listJournals},
 		{Path: "/events/", Handler: listEvents},
 		{Path: "/todos/", Handler: listTodos},
 		{Path: "/files/", Handler: listFiles},
 		{Path: "/slots/", Handler: listSlots},
+		{Path: "/slots/timeline", Handler: listOccupancies},
+		{Path: "/inventory", Handler: viewInventory},
 		{Path: "/uplinks/", Handler: listUplinks},
 		{Path: "/downlinks/", Handler: listDownlinks},
 		{Path: "/transfers/", Handler: listTransfers},
@@ -164,42 +277,85 @@ func setupRoutes(r *mux.Router, c *Config) error {
 
 	r.Handle("/categories/", handle(listCategories, os.Stderr, s)).Methods("GET", "OPTIONS")
 	r.Handle("/categories/", handle(newCategory, os.Stderr, s)).Methods("POST", "OPTIONS")
+	r.Handle("/categories/tree", handle(treeCategories, os.Stderr, s)).Methods("GET", "OPTIONS")
+	r.Handle("/checksums/", handle(listChecksums, os.Stderr, s)).Methods("GET", "OPTIONS")
 	r.Handle("/categories/{id:[0-9]+}", handle(viewCategory, os.Stderr, s)).Methods("GET", "OPTIONS")
 	r.Handle("/categories/{id:[0-9]+}", handle(newCategory, os.Stderr, s)).Methods("POST", "OPTIONS")
 	r.Handle("/categories/{id:[0-9]+}", handle(updateCategory, os.Stderr, s)).Methods("PUT", "OPTIONS")
+	r.Handle("/categories/{id:[0-9]+}/archive", handle(archiveCategory, os.Stderr, s)).Methods("PUT", "OPTIONS")
+	r.Handle("/categories/{id:[0-9]+}/restore", handle(restoreCategory, os.Stderr, s)).Methods("PUT", "OPTIONS")
+	r.Handle("/categories/{id:[0-9]+}/merge/{into:[0-9]+}", handle(mergeCategory, os.Stderr, s)).Methods("PUT", "OPTIONS")
 
 	r.Handle("/dors/", handle(listJournals, os.Stderr, s)).Methods("GET", "OPTIONS")
 	r.Handle("/dors/", handle(newJournal, os.Stderr, s)).Methods("POST", "OPTIONS")
+	r.Handle("/dors/report", serve(reportJournal, os.Stderr, s)).Methods("GET", "OPTIONS")
 	r.Handle("/dors/{id:[0-9]+}", handle(viewJournal, os.Stderr, s)).Methods("GET", "OPTIONS")
 	r.Handle("/dors/{id:[0-9]+}", handle(updateJournal, os.Stderr, s)).Methods("PUT", "OPTIONS")
 	r.Handle("/dors/{id:[0-9]+}", handle(deleteJournal, os.Stderr, s)).Methods("DELETE", "OPTIONS")
+	r.Handle("/dors/{id:[0-9]+}/signoff", handle(signoffJournal, os.Stderr, s)).Methods("PUT", "OPTIONS")
+	r.Handle("/dors/{id:[0-9]+}/addenda", handle(addAddendum, os.Stderr, s)).Methods("POST", "OPTIONS")
+	r.Handle("/dors/{id:[0-9]+}/attachments", handle(attachFile, os.Stderr, s)).Methods("POST", "OPTIONS")
+
+	r.Handle("/incidents/", handle(listIncidents, os.Stderr, s)).Methods("GET", "OPTIONS")
+	r.Handle("/incidents/", handle(newIncident, os.Stderr, s)).Methods("POST", "OPTIONS")
+	r.Handle("/incidents/{id:[0-9]+}", handle(viewIncident, os.Stderr, s)).Methods("GET", "OPTIONS")
+	r.Handle("/incidents/{id:[0-9]+}", handle(updateIncident, os.Stderr, s)).Methods("PUT", "OPTIONS")
+	r.Handle("/incidents/{id:[0-9]+}", handle(deleteIncident, os.Stderr, s)).Methods("DELETE", "OPTIONS")
+
+	r.Handle("/stats/events", handle(eventTimings, os.Stderr, s)).Methods("GET", "OPTIONS")
+	r.Handle("/stats/uplinks", handle(uplinkStats, os.Stderr, s)).Methods("GET", "OPTIONS")
+	r.Handle("/stats/workload", handle(analyzeWorkload, os.Stderr, s)).Methods("GET", "OPTIONS")
 
 	r.Handle("/sources/", handle(listSources, os.Stderr, s)).Methods("GET", "OPTIONS")
 	r.Handle("/events/", handle(listEvents, os.Stderr, s)).Methods("GET", "OPTIONS")
 	r.Handle("/events/", handle(newEvent, os.Stderr, s)).Methods("POST", "OPTIONS")
+	r.Handle("/events/import", handle(importEventRows, os.Stderr, s)).Methods("POST", "OPTIONS")
 	r.Handle("/events/{id:[0-9]+}", handle(viewEvent, os.Stderr, s)).Methods("GET", "OPTIONS")
 	r.Handle("/events/{id:[0-9]+}", handle(newEvent, os.Stderr, s)).Methods("POST", "OPTIONS")
 	r.Handle("/events/{id:[0-9]+}", handle(updateEvent, os.Stderr, s)).Methods("PUT", "OPTIONS")
 	r.Handle("/events/{id:[0-9]+}", handle(deleteEvent, os.Stderr, s)).Methods("DELETE", "OPTIONS")
 
 	r.Handle("/todos/", handle(listTodos, os.Stderr, s)).Methods("GET", "OPTIONS")
+	r.Handle("/todos/mine", handle(listMyTodos, os.Stderr, s)).Methods("GET", "OPTIONS")
 	r.Handle("/todos/", handle(newTodo, os.Stderr, s)).Methods("POST", "OPTIONS")
+	r.Handle("/todos/import", handle(importTodoRows, os.Stderr, s)).Methods("POST", "OPTIONS")
 	r.Handle("/todos/{id:[0-9]+}", handle(viewTodo, os.Stderr, s)).Methods("GET", "OPTIONS")
 	r.Handle("/todos/{id:[0-9]+}", handle(newTodo, os.Stderr, s)).Methods("POST", "OPTIONS")
 	r.Handle("/todos/{id:[0-9]+}", handle(updateTodo, os.Stderr, s)).Methods("PUT", "OPTIONS")
 	r.Handle("/todos/{id:[0-9]+}", handle(deleteTodo, os.Stderr, s)).Methods("DELETE", "OPTIONS")
+	r.Handle("/todos/{id:[0-9]+}/reopen", handle(reopenTodo, os.Stderr, s)).Methods("PUT", "OPTIONS")
+	r.Handle("/todos/{id:[0-9]+}/links", handle(addTodoLinks, os.Stderr, s)).Methods("POST", "OPTIONS")
+	r.Handle("/todos/{id:[0-9]+}/links/{kind:[a-z]+}/{ref:[0-9]+}", handle(deleteTodoLink, os.Stderr, s)).Methods("DELETE", "OPTIONS")
+
+	r.Handle("/templates/", handle(listTemplates, os.Stderr, s)).Methods("GET", "OPTIONS")
+	r.Handle("/templates/", handle(newTemplate, os.Stderr, s)).Methods("POST", "OPTIONS")
+	r.Handle("/templates/{id:[0-9]+}", handle(viewTemplate, os.Stderr, s)).Methods("GET", "OPTIONS")
+	r.Handle("/templates/{id:[0-9]+}", handle(updateTemplate, os.Stderr, s)).Methods("PUT", "OPTIONS")
+	r.Handle("/templates/{id:[0-9]+}", handle(deleteTemplate, os.Stderr, s)).Methods("DELETE", "OPTIONS")
+	r.Handle("/templates/{id:[0-9]+}/todos", handle(instantiateTemplate, os.Stderr, s)).Methods("POST", "OPTIONS")
 
 	r.Handle("/files/", handle(listFiles, os.Stderr, s)).Methods("GET", "OPTIONS")
 	r.Handle("/files/", handle(newFile, os.Stderr, s)).Methods("POST", "OPTIONS")
+	r.Handle("/files/import", handle(importArchive, os.Stderr, s)).Methods("POST", "OPTIONS")
 	r.Handle("/files/{id:[0-9]+}", handle(viewFile, os.Stderr, s)).Methods("GET", "OPTIONS")
 	r.Handle("/files/{id:[0-9]+}", handle(newFile, os.Stderr, s)).Methods("POST", "OPTIONS")
 	r.Handle("/files/{id:[0-9]+}", handle(updateFile, os.Stderr, s)).Methods("PUT", "OPTIONS")
 	r.Handle("/files/{id:[0-9]+}", handle(deleteFile, os.Stderr, s)).Methods("DELETE", "OPTIONS")
+	r.Handle("/files/{id:[0-9]+}/content", serve(downloadFile, os.Stderr, s)).Methods("GET", "HEAD", "OPTIONS")
+	r.Handle("/files/{id:[0-9]+}/diff/{other:[0-9]+}", handle(diffFile, os.Stderr, s)).Methods("GET", "OPTIONS")
+	r.Handle("/files/{id:[0-9]+}/lineage", handle(viewLineage, os.Stderr, s)).Methods("GET", "OPTIONS")
 
 	r.Handle("/slots/", handle(listSlots, os.Stderr, s)).Methods("GET", "OPTIONS")
 	r.Handle("/slots/", handle(newSlot, os.Stderr, s)).Methods("POST", "OPTIONS")
+	r.Handle("/slots/timeline", handle(listOccupancies, os.Stderr, s)).Methods("GET", "OPTIONS")
 	r.Handle("/slots/{id:[0-9]+}", handle(viewSlot, os.Stderr, s)).Methods("GET", "OPTIONS")
+	r.Handle("/slots/{id:[0-9]+}", handle(updateSlot, os.Stderr, s)).Methods("PUT", "OPTIONS")
 	r.Handle("/slots/{id:[0-9]+}", handle(deleteSlot, os.Stderr, s)).Methods("DELETE", "OPTIONS")
+	r.Handle("/slots/{id:[0-9]+}/restore", handle(restoreSlot, os.Stderr, s)).Methods("PUT", "OPTIONS")
+	r.Handle("/slots/import", handle(importSlots, os.Stderr, s)).Methods("POST", "OPTIONS")
+
+	r.Handle("/inventory", handle(viewInventory, os.Stderr, s)).Methods("GET", "OPTIONS")
+	r.Handle("/inventory", handle(compareInventory, os.Stderr, s)).Methods("POST", "OPTIONS")
 
 	r.Handle("/uplinks/", handle(listUplinks, os.Stderr, s)).Methods("GET", "OPTIONS")
 	r.Handle("/uplinks/", handle(newUplink, os.Stderr, s)).Methods("POST", "OPTIONS")
@@ -225,7 +381,7 @@ func updateCategory(r *http.Request) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	c := &hourglass.Category{Name: s.Name}
+	c := &hourglass.Category{Name: s.Name, Checksum: s.Checksum, Parent: s.Parent}
 	if err := json.NewDecoder(io.LimitReader(r.Body, MaxBodySize)).Decode(c); err != nil {
 		return nil, err
 	}
@@ -277,6 +433,92 @@ func deleteSlot(r *http.Request) (interface{}, error) {
 	return nil, hourglass.DeleteSlot(db, s)
 }
 
+func updateSlot(r *http.Request) (interface{}, error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	v, err := hourglass.ViewSlot(db, id)
+	if err != nil {
+		return nil, err
+	}
+	s := &hourglass.Slot{
+		Name:     v.Name,
+		Category: v.Category,
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxBodySize)).Decode(s); err != nil {
+		return nil, err
+	}
+	s.Id = id
+	s.User = r.Context().Value("user").(string)
+	if err := hourglass.UpdateSlot(db, s); err != nil {
+		return nil, err
+	}
+	return hourglass.ViewSlot(db, id)
+}
+
+func restoreSlot(r *http.Request) (interface{}, error) {
+	s := new(hourglass.Slot)
+	s.Id, _ = strconv.Atoi(mux.Vars(r)["id"])
+	s.User = r.Context().Value("user").(string)
+	if err := hourglass.RestoreSlot(db, s); err != nil {
+		return nil, err
+	}
+	return hourglass.ViewSlot(db, s.Id)
+}
+
+// importSlots accepts either a JSON array of slots or a CSV table with the
+// columns uid, name and category (an optional header line is skipped).
+func importSlots(r *http.Request) (interface{}, error) {
+	var (
+		ss  []*hourglass.Slot
+		err error
+	)
+	body := io.LimitReader(r.Body, MaxBodySize)
+	switch t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t {
+	case "text/csv":
+		ss, err = decodeSlots(body)
+	default:
+		err = json.NewDecoder(body).Decode(&ss)
+	}
+	if err != nil {
+		return nil, err
+	}
+	u := r.Context().Value("user").(string)
+	if err := hourglass.ImportSlots(db, ss, u); err != nil {
+		return nil, err
+	}
+	return hourglass.ListSlots(db, nil)
+}
+
+func decodeSlots(r io.Reader) ([]*hourglass.Slot, error) {
+	rs := csv.NewReader(r)
+	rs.FieldsPerRecord = 3
+	rs.TrimLeadingSpace = true
+
+	var ss []*hourglass.Slot
+	for i := 0; ; i++ {
+		row, err := rs.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		id, err := strconv.Atoi(row[0])
+		if err != nil {
+			if i == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: invalid slot id %q", i+1, row[0])
+		}
+		s := &hourglass.Slot{
+			Id:       id,
+			Name:     strings.TrimSpace(row[1]),
+			Category: strings.TrimSpace(row[2]),
+		}
+		ss = append(ss, s)
+	}
+	return ss, nil
+}
+
 func newSlot(r *http.Request) (interface{}, error) {
 	s := new(hourglass.Slot)
 	if err := json.NewDecoder(io.LimitReader(r.Body, MaxBodySize)).Decode(s); err != nil {
@@ -317,7 +559,9 @@ func newCategory(r *http.Request) (interface{}, error) {
 	if err := json.NewDecoder(io.LimitReader(r.Body, MaxBodySize)).Decode(c); err != nil {
 		return nil, err
 	}
-	c.Id, _ = strconv.Atoi(mux.Vars(r)["id"])
+	if p, _ := strconv.Atoi(mux.Vars(r)["id"]); p > 0 {
+		c.Parent = p
+	}
 	c.User = r.Context().Value("user").(string)
 	return c, hourglass.NewCategory(db, c)
 }
@@ -336,12 +580,86 @@ func newDownlink(r *http.Request) (interface{}, error) {
 }
 
 func listSlots(r *http.Request) (interface{}, error) {
+	cs, err := categories(r)
+	if err != nil {
+		return nil, err
+	}
+	return hourglass.ListSlots(db, cs)
+}
+
+func listOccupancies(r *http.Request) (interface{}, error) {
+	var fd, td time.Time
 	q := r.URL.Query()
-	return hourglass.ListSlots(db, q["category[]"])
+	if f, t := q.Get("dtstart"), q.Get("dtend"); len(f) > 0 && len(t) > 0 {
+		var err error
+		if fd, err = time.Parse(time.RFC3339, f); err != nil {
+			return nil, err
+		}
+		if td, err = time.Parse(time.RFC3339, t); err != nil {
+			return nil, err
+		}
+	} else {
+		fd = time.Now().Truncate(time.Hour * 24)
+		td = fd.Add(time.Hour * 24)
+	}
+	cs, err := categories(r)
+	if err != nil {
+		return nil, err
+	}
+	return hourglass.ListOccupancies(db, fd, td, cs)
+}
+
+func listChecksums(r *http.Request) (interface{}, error) {
+	return hourglass.Checksums(), nil
 }
 
 func listCategories(r *http.Request) (interface{}, error) {
-	return hourglass.ListCategories(db)
+	archived, _ := strconv.ParseBool(r.URL.Query().Get("archived"))
+	return hourglass.ListCategories(db, archived)
+}
+
+func treeCategories(r *http.Request) (interface{}, error) {
+	archived, _ := strconv.ParseBool(r.URL.Query().Get("archived"))
+	return hourglass.CategoryTree(db, archived)
+}
+
+func archiveCategory(r *http.Request) (interface{}, error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	u := r.Context().Value("user").(string)
+	if err := hourglass.ArchiveCategory(db, id, true, u); err != nil {
+		return nil, err
+	}
+	return hourglass.ViewCategory(db, id)
+}
+
+func restoreCategory(r *http.Request) (interface{}, error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	u := r.Context().Value("user").(string)
+	if err := hourglass.ArchiveCategory(db, id, false, u); err != nil {
+		return nil, err
+	}
+	return hourglass.ViewCategory(db, id)
+}
+
+func mergeCategory(r *http.Request) (interface{}, error) {
+	vs := mux.Vars(r)
+	id, _ := strconv.Atoi(vs["id"])
+	into, _ := strconv.Atoi(vs["into"])
+	u := r.Context().Value("user").(string)
+	if err := hourglass.MergeCategories(db, id, into, u); err != nil {
+		return nil, err
+	}
+	return hourglass.ViewCategory(db, into)
+}
+
+// categories gives the categories given in the query string of r, including
+// their descendants when descendants is set.
+func categories(r *http.Request) ([]string, error) {
+	q := r.URL.Query()
+	if ok, _ := strconv.ParseBool(q.Get("descendants")); !ok {
+		return q["category[]"], nil
+	}
+	return hourglass.ExpandCategories(db, q["category[]"])
 }
 
 func listDownlinks(r *http.Request) (interface{}, error) {
@@ -359,7 +677,11 @@ func listDownlinks(r *http.Request) (interface{}, error) {
 		fd = time.Now().Truncate(time.Hour * 24)
 		td = fd.Add(time.Hour * 24)
 	}
-	return hourglass.ListDownlinks(db, fd, td, q["category[]"], q["status[]"])
+	cs, err := categories(r)
+	if err != nil {
+		return nil, err
+	}
+	return hourglass.ListDownlinks(db, fd, td, cs, q["status[]"])
 }
 
 func listUplinks(r *http.Request) (interface{}, error) {
@@ -377,7 +699,11 @@ func listUplinks(r *http.Request) (interface{}, error) {
 		fd = time.Now().Truncate(time.Hour * 24)
 		td = fd.Add(time.Hour * 24)
 	}
-	return hourglass.ListUplinks(db, fd, td, q["category[]"], q["status[]"])
+	cs, err := categories(r)
+	if err != nil {
+		return nil, err
+	}
+	return hourglass.ListUplinks(db, fd, td, cs, q["status[]"])
 }
 
 func listTransfers(r *http.Request) (interface{}, error) {
@@ -395,7 +721,11 @@ func listTransfers(r *http.Request) (interface{}, error) {
 		fd = time.Now().Truncate(time.Hour * 24)
 		td = fd.Add(time.Hour * 24)
 	}
-	return hourglass.ListTransfers(db, fd, td, q["category[]"], q["status[]"])
+	cs, err := categories(r)
+	if err != nil {
+		return nil, err
+	}
+	return hourglass.ListTransfers(db, fd, td, cs, q["status[]"])
 }
 
 func viewSlot(r *http.Request) (interface{}, error) {
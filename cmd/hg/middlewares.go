@@ -13,6 +13,7 @@ import (
 
 	"github.com/busoc/hourglass"
 	"github.com/gorilla/handlers"
+	"github.com/lib/pq"
 	"github.com/midbel/jwt"
 )
 
@@ -28,6 +29,12 @@ func handle(f Func, w io.Writer, s jwt.Signer) http.Handler {
 	return handlers.LoggingHandler(w, handlers.CompressHandler(h))
 }
 
+// serve is like handle but for handlers writing directly their response (eg:
+// file content) instead of going through negociate.
+func serve(h http.HandlerFunc, w io.Writer, s jwt.Signer) http.Handler {
+	return handlers.LoggingHandler(w, cors(authorize(h, s)))
+}
+
 func allow(f Func, w io.Writer, u, p string, hosts []string) http.Handler {
 	if u == "" && p == "" && len(hosts) == 0 {
 		return negociate(f) //handle(f, w, nil)
@@ -37,18 +44,18 @@ func allow(f Func, w io.Writer, u, p string, hosts []string) http.Handler {
 	e := negociate(f)
 	h := func(w http.ResponseWriter, r *http.Request) {
 		if ru, rp, ok := r.BasicAuth(); !ok || (ru != u || rp != p) {
-			w.WriteHeader(http.StatusUnauthorized)
+			problem(w, hourglass.ErrUnauthenticated)
 			return
 		}
 		if len(hosts) > 0 {
 			o, _, err := net.SplitHostPort(r.RemoteAddr)
 			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
+				problem(w, err)
 				return
 			}
 			ix := sort.SearchStrings(hosts, o)
 			if ix >= len(hosts) || hosts[ix] != o {
-				w.WriteHeader(http.StatusForbidden)
+				problem(w, hourglass.ErrForbidden)
 				return
 			}
 		}
@@ -103,17 +110,17 @@ func authorize(h http.Handler, s jwt.Signer) http.Handler {
 				w.Header().Set(auth, bearer+t)
 			}
 		default:
-			w.WriteHeader(http.StatusUnauthorized)
+			problem(w, hourglass.ErrUnauthenticated)
 			return
 		}
 		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
+			problem(w, hourglass.ErrUnauthenticated)
 			return
 		}
 		switch r.Method {
 		case http.MethodPost, http.MethodPut, http.MethodDelete:
 			if !user.Internal {
-				w.WriteHeader(http.StatusForbidden)
+				problem(w, hourglass.ErrForbidden)
 				return
 			}
 		default:
@@ -126,22 +133,25 @@ func authorize(h http.Handler, s jwt.Signer) http.Handler {
 
 func negociate(f Func) http.Handler {
 	handler := func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-
 		d, err := f(r)
-		switch err {
-		case nil:
-		case hourglass.ErrNotFound:
-			w.WriteHeader(http.StatusNotFound)
-			return
-		case hourglass.ErrUnauthenticated:
-			w.WriteHeader(http.StatusUnauthorized)
+		if err != nil {
+			problem(w, err)
 			return
-		default:
-			log.Println(err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		status := http.StatusOK
+		if r.Method == http.MethodPost {
+			status = http.StatusCreated
+		}
+		if f, ok := acceptCSV(r); ok && csvable(d) {
+			if err := writeCSV(w, d, f == "excel", status); err != nil {
+				problem(w, err)
+			}
 			return
 		}
+		if _, ok := d.(empty); ok {
+			d = nil
+		}
+		w.Header().Set("Content-Type", "application/json")
 		if d == nil {
 			w.WriteHeader(http.StatusNoContent)
 			return
@@ -151,9 +161,7 @@ func negociate(f Func) http.Handler {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if r.Method == http.MethodPost {
-			w.WriteHeader(http.StatusCreated)
-		}
+		w.WriteHeader(status)
 		_, err = io.Copy(w, buf)
 		if err != nil {
 			log.Println(err)
@@ -161,3 +169,59 @@ func negociate(f Func) http.Handler {
 	}
 	return http.HandlerFunc(handler)
 }
+
+// Problem is the body of the error responses (see RFC 7807).
+type Problem struct {
+	Type   string            `json:"type"`
+	Title  string            `json:"title"`
+	Status int               `json:"status"`
+	Detail string            `json:"detail,omitempty"`
+	Errors []hourglass.Error `json:"errors,omitempty"`
+}
+
+func problem(w http.ResponseWriter, err error) {
+	p := Problem{Type: "about:blank"}
+	switch e := err.(type) {
+	case hourglass.Errors:
+		p.Status, p.Errors = http.StatusUnprocessableEntity, e
+	case hourglass.Error:
+		p.Status, p.Detail, p.Errors = statusOf(e.Code), e.Message, []hourglass.Error{e}
+	case *pq.Error:
+		log.Println(err)
+		p.Status = http.StatusInternalServerError
+	default:
+		switch err {
+		case hourglass.ErrNotFound:
+			p.Status = http.StatusNotFound
+		case hourglass.ErrUnauthenticated:
+			p.Status = http.StatusUnauthorized
+		case hourglass.ErrForbidden:
+			p.Status = http.StatusForbidden
+		case hourglass.ErrConflict:
+			p.Status = http.StatusConflict
+		case hourglass.ErrInvalid:
+			p.Status = http.StatusUnprocessableEntity
+		default:
+			log.Println(err)
+			p.Status, p.Detail = http.StatusBadRequest, err.Error()
+		}
+	}
+	p.Title = http.StatusText(p.Status)
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func statusOf(code string) int {
+	switch code {
+	case hourglass.CodeConflict:
+		return http.StatusConflict
+	case hourglass.CodeForbidden:
+		return http.StatusForbidden
+	case hourglass.CodeInvalid, hourglass.CodeRequired, hourglass.CodeReference:
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusBadRequest
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/busoc/hourglass"
+)
+
+// R configures the reminders sent to the assignees of the todos that are
+// overdue or due soon. Interval and Window are given in seconds.
+type R struct {
+	Interval int    `json:"interval"`
+	Window   int    `json:"window"`
+	Smtp     *S     `json:"smtp"`
+	Webhook  string `json:"webhook"`
+}
+
+type S struct {
+	Addr string `json:"addr"`
+	From string `json:"from"`
+}
+
+type Notifier interface {
+	Notify(*hourglass.Reminder) error
+}
+
+type notifiers []Notifier
+
+// Notify sends the reminder through every notifier. The reminder is considered
+// delivered as soon as one of them succeeds: the failures of the others are
+// only logged so that the reminder is not sent again on the channels that
+// succeeded.
+func (ns notifiers) Notify(r *hourglass.Reminder) error {
+	var errs []string
+	for _, n := range ns {
+		if err := n.Notify(r); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	switch {
+	case len(errs) == 0:
+		return nil
+	case len(errs) < len(ns):
+		log.Printf("reminders: todo %d (%s): %s", r.Todo.Id, r.Initial, strings.Join(errs, "; "))
+		return nil
+	default:
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+}
+
+type mailNotifier struct {
+	Addr string
+	From string
+}
+
+func (m mailNotifier) Notify(r *hourglass.Reminder) error {
+	var buf bytes.Buffer
+
+	summary := headerText(r.Todo.Summary)
+	subject := fmt.Sprintf("[hourglass] todo %d due soon: %s", r.Todo.Id, summary)
+	if r.Threshold == hourglass.ThresholdOverdue {
+		subject = fmt.Sprintf("[hourglass] todo %d overdue: %s", r.Todo.Id, summary)
+	}
+	fmt.Fprintf(&buf, "From: %s\r\n", m.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", headerText(r.Email))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "%s\r\n\r\n", r.Todo.Summary)
+	fmt.Fprintf(&buf, "due: %s\r\n", r.Todo.Due.Format(time.RFC3339))
+	fmt.Fprintf(&buf, "state: %s\r\n", r.Todo.State)
+	fmt.Fprintf(&buf, "priority: %s\r\n", r.Todo.Priority)
+	if r.Todo.Description != "" {
+		fmt.Fprintf(&buf, "\r\n%s\r\n", r.Todo.Description)
+	}
+	return smtp.SendMail(m.Addr, nil, m.From, []string{r.Email}, buf.Bytes())
+}
+
+// headerText removes the line breaks of s so that it can not add headers to
+// the message.
+func headerText(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+type webhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (w webhookNotifier) Notify(r *hourglass.Reminder) error {
+	bs, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	rs, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	rs.Body.Close()
+	if rs.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("webhook: unexpected response %s", rs.Status)
+	}
+	return nil
+}
+
+func setupReminders(c *R) (Notifier, error) {
+	var ns notifiers
+	if c.Smtp != nil && c.Smtp.Addr != "" {
+		ns = append(ns, mailNotifier{Addr: c.Smtp.Addr, From: c.Smtp.From})
+	}
+	if c.Webhook != "" {
+		ns = append(ns, webhookNotifier{URL: c.Webhook, Client: &http.Client{Timeout: 10 * time.Second}})
+	}
+	if len(ns) == 0 {
+		return nil, fmt.Errorf("reminders: no notifier configured")
+	}
+	if c.Interval <= 0 {
+		c.Interval = 300
+	}
+	if c.Window <= 0 {
+		c.Window = 86400
+	}
+	return ns, nil
+}
+
+// runReminders periodically notifies the assignees of the todos due soon or
+// overdue. A reminder is recorded once delivered, so that each assignee is
+// notified only once per threshold, even across restarts.
+func runReminders(db *sql.DB, c *R, n Notifier) {
+	every := time.Duration(c.Interval) * time.Second
+	window := time.Duration(c.Window) * time.Second
+
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		rs, err := hourglass.PendingReminders(db, window)
+		if err != nil {
+			log.Printf("reminders: %s", err)
+		}
+		for _, r := range rs {
+			if err := n.Notify(r); err != nil {
+				log.Printf("reminders: todo %d (%s): %s", r.Todo.Id, r.Initial, err)
+				continue
+			}
+			if err := hourglass.MarkReminded(db, r); err != nil {
+				log.Printf("reminders: todo %d (%s): %s", r.Todo.Id, r.Initial, err)
+			}
+		}
+		<-tick.C
+	}
+}
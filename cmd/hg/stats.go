@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/busoc/hourglass"
+)
+
+func eventTimings(r *http.Request) (interface{}, error) {
+	var fd, td time.Time
+	q := r.URL.Query()
+	if q.Get("dtstart") != "" || q.Get("dtend") != "" {
+		var err error
+		if fd, err = time.Parse(time.RFC3339, q.Get("dtstart")); err != nil {
+			return nil, fmt.Errorf("dtstart bad format")
+		}
+		if td, err = time.Parse(time.RFC3339, q.Get("dtend")); err != nil {
+			return nil, fmt.Errorf("dtend bad format")
+		}
+	}
+	var tolerance time.Duration
+	if v := q.Get("tolerance"); v != "" {
+		var err error
+		if tolerance, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("tolerance bad format")
+		}
+	}
+	return hourglass.EventTimings(db, fd, td, tolerance)
+}
+
+func uplinkStats(r *http.Request) (interface{}, error) {
+	var fd, td time.Time
+	q := r.URL.Query()
+	if q.Get("dtstart") != "" || q.Get("dtend") != "" {
+		var err error
+		if fd, err = time.Parse(time.RFC3339, q.Get("dtstart")); err != nil {
+			return nil, fmt.Errorf("dtstart bad format")
+		}
+		if td, err = time.Parse(time.RFC3339, q.Get("dtend")); err != nil {
+			return nil, fmt.Errorf("dtend bad format")
+		}
+	}
+	g := q.Get("groupby")
+	if g == "" {
+		g = hourglass.GroupByCategory
+	}
+	return hourglass.UplinkStats(db, fd, td, g)
+}
+
+func analyzeWorkload(r *http.Request) (interface{}, error) {
+	var fd, td time.Time
+	q := r.URL.Query()
+	if q.Get("dtstart") != "" || q.Get("dtend") != "" {
+		var err error
+		if fd, err = time.Parse(time.RFC3339, q.Get("dtstart")); err != nil {
+			return nil, fmt.Errorf("dtstart bad format")
+		}
+		if td, err = time.Parse(time.RFC3339, q.Get("dtend")); err != nil {
+			return nil, fmt.Errorf("dtend bad format")
+		}
+	}
+	var threshold time.Duration
+	if v := q.Get("threshold"); v != "" {
+		var err error
+		if threshold, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("threshold bad format")
+		}
+	}
+	cs, err := categories(r)
+	if err != nil {
+		return nil, err
+	}
+	return hourglass.AnalyzeWorkload(db, fd, td, cs, q["source[]"], threshold)
+}
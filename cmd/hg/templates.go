@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/busoc/hourglass"
+	"github.com/gorilla/mux"
+)
+
+func listTemplates(r *http.Request) (interface{}, error) {
+	ds, err := hourglass.ListTemplates(db)
+	switch {
+	case err != nil:
+		return ds, err
+	case len(ds) == 0:
+		return empty{ds}, err
+	default:
+		return ds, err
+	}
+}
+
+func viewTemplate(r *http.Request) (interface{}, error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	return hourglass.ViewTemplate(db, id)
+}
+
+func newTemplate(r *http.Request) (interface{}, error) {
+	t := new(hourglass.Template)
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxBodySize)).Decode(t); err != nil {
+		return nil, err
+	}
+	t.User = r.Context().Value("user").(string)
+	if err := hourglass.NewTemplate(db, t); err != nil {
+		return nil, err
+	}
+	return hourglass.ViewTemplate(db, t.Id)
+}
+
+func updateTemplate(r *http.Request) (interface{}, error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	s, err := hourglass.ViewTemplate(db, id)
+	if err != nil {
+		return nil, err
+	}
+	t := &hourglass.Template{
+		Id:      id,
+		Name:    s.Name,
+		Summary: s.Summary,
+		Steps:   s.Steps,
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxBodySize)).Decode(t); err != nil {
+		return nil, err
+	}
+	t.User = r.Context().Value("user").(string)
+	if err := hourglass.UpdateTemplate(db, t); err != nil {
+		return nil, err
+	}
+	return hourglass.ViewTemplate(db, t.Id)
+}
+
+func deleteTemplate(r *http.Request) (interface{}, error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	t, err := hourglass.ViewTemplate(db, id)
+	if err != nil {
+		return nil, err
+	}
+	t.User = r.Context().Value("user").(string)
+	return nil, hourglass.DeleteTemplate(db, t)
+}
+
+func instantiateTemplate(r *http.Request) (interface{}, error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	v := struct {
+		Anchor time.Time `json:"dtstart"`
+		hourglass.Overrides
+	}{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxBodySize)).Decode(&v); err != nil {
+		return nil, err
+	}
+	v.User = r.Context().Value("user").(string)
+	return hourglass.InstantiateTemplate(db, id, v.Anchor, v.Overrides)
+}
@@ -2,27 +2,95 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"reflect"
 	"strconv"
+	"time"
 
 	"github.com/busoc/hourglass"
 	"github.com/gorilla/mux"
 )
 
 func listTodos(r *http.Request) (interface{}, error) {
-	q := r.URL.Query()
-	ds, err := hourglass.ListTodos(db, q["category[]"])
+	f, err := todoFilter(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := acceptCSV(r); ok {
+		return streamTodos(f), nil
+	}
+	ds, err := hourglass.ListTodos(db, f)
 	switch {
 	case err != nil:
 		return ds, err
 	case len(ds) == 0:
+		return empty{ds}, err
+	default:
+		return ds, err
+	}
+}
+
+func listMyTodos(r *http.Request) (interface{}, error) {
+	f, err := todoFilter(r)
+	if err != nil {
 		return nil, err
+	}
+	f.Assignees = []string{r.Context().Value("user").(string)}
+	if _, ok := acceptCSV(r); ok {
+		return streamTodos(f), nil
+	}
+	ds, err := hourglass.ListTodos(db, f)
+	switch {
+	case err != nil:
+		return ds, err
+	case len(ds) == 0:
+		return empty{ds}, err
 	default:
 		return ds, err
 	}
 }
 
+func streamTodos(f hourglass.TodoFilter) stream {
+	walk := func(fn func(interface{}) error) error {
+		return hourglass.WalkTodos(db, f, func(t *hourglass.Todo) error {
+			return fn(t)
+		})
+	}
+	return stream{typ: reflect.TypeOf(hourglass.Todo{}), walk: walk}
+}
+
+func todoFilter(r *http.Request) (hourglass.TodoFilter, error) {
+	cs, err := categories(r)
+	if err != nil {
+		return hourglass.TodoFilter{}, err
+	}
+	q := r.URL.Query()
+	f := hourglass.TodoFilter{
+		Categories: cs,
+		Assignees:  q["assignee[]"],
+		States:     q["status[]"],
+		Priorities: q["priority[]"],
+	}
+	f.Open, _ = strconv.ParseBool(q.Get("open"))
+	if v := q.Get("before"); v != "" {
+		d, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, fmt.Errorf("before bad format")
+		}
+		f.DueBefore = d
+	}
+	if v := q.Get("after"); v != "" {
+		d, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, fmt.Errorf("after bad format")
+		}
+		f.DueAfter = d
+	}
+	return f, nil
+}
+
 func viewTodo(r *http.Request) (interface{}, error) {
 	id, _ := strconv.Atoi(mux.Vars(r)["id"])
 	return hourglass.ViewTodo(db, id)
@@ -70,6 +138,39 @@ func updateTodo(r *http.Request) (interface{}, error) {
 	return hourglass.ViewTodo(db, t.Id)
 }
 
+func reopenTodo(r *http.Request) (interface{}, error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	t, err := hourglass.ViewTodo(db, id)
+	if err != nil {
+		return nil, err
+	}
+	cascade, _ := strconv.ParseBool(r.URL.Query().Get("cascade"))
+	t.User = r.Context().Value("user").(string)
+	if err := hourglass.ReopenTodo(db, t, cascade); err != nil {
+		return nil, err
+	}
+	return hourglass.ViewTodo(db, t.Id)
+}
+
+func addTodoLinks(r *http.Request) (interface{}, error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	var ls []*hourglass.Link
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxBodySize)).Decode(&ls); err != nil {
+		return nil, err
+	}
+	if err := hourglass.AddTodoLinks(db, id, ls); err != nil {
+		return nil, err
+	}
+	return hourglass.ViewTodo(db, id)
+}
+
+func deleteTodoLink(r *http.Request) (interface{}, error) {
+	vs := mux.Vars(r)
+	id, _ := strconv.Atoi(vs["id"])
+	ref, _ := strconv.Atoi(vs["ref"])
+	return nil, hourglass.DeleteTodoLink(db, id, vs["kind"], ref)
+}
+
 func deleteTodo(r *http.Request) (interface{}, error) {
 	id, _ := strconv.Atoi(mux.Vars(r)["id"])
 	t, err := hourglass.ViewTodo(db, id)
@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"io"
 	"net/http"
 	"strconv"
@@ -83,7 +82,7 @@ func updatePasswd(r *http.Request) (interface{}, error) {
 	}
 	a := r.Context().Value("user").(string)
 	if a != u.Initial {
-		return nil, fmt.Errorf("forbidden")
+		return nil, hourglass.ErrForbidden
 	}
 	v := struct {
 		Old string `json:"old"`
@@ -47,8 +47,12 @@ create table schedule.categories (
 	person int,
 	canceled boolean default false,
 	parent int,
+	checksum varchar(32),
+	archived boolean not null default false,
+	merged int,
 	primary key(pk),
 	foreign key(parent) references schedule.categories(pk),
+	foreign key(merged) references schedule.categories(pk),
 	foreign key(person) references usoc.persons(pk),
 	constraint categories_name_unique unique (name),
 	constraint categories_name_length check (length(name) > 0)
@@ -61,6 +65,9 @@ create table schedule.files (
 	meta json,
 	person int not null,
 	content bytea null,
+	length int not null default 0,
+	sum varchar(32) not null default '',
+	digest varchar(64),
 	lastmod timestamp not null default current_timestamp,
 	canceled bool default false,
 	parent int,
@@ -78,8 +85,19 @@ create table revisions.files (
 );
 
 alter table revisions.files drop column content;
+alter table revisions.files drop column length;
+alter table revisions.files drop column sum;
+alter table revisions.files drop column digest;
 alter table revisions.files drop column crc;
 
+create table schedule.files_checksums (
+	file int not null,
+	algorithm varchar(32) not null,
+	value varchar(128) not null,
+	primary key(file, algorithm),
+	foreign key(file) references schedule.files(pk)
+);
+
 create table schedule.files_categories (
 	file int not null,
 	category int not null,
@@ -98,7 +116,7 @@ create table schedule.slots (
 	primary key(pk),
 	foreign key(category) references schedule.categories(pk),
 	foreign key(person) references usoc.persons(pk),
-	constraint slots_name_unique unique(name),
+	constraint slots_name_unique unique(name) deferrable initially deferred,
 	constraint slots_name_length check (length(name) > 0)
 );
 
@@ -213,12 +231,46 @@ create table schedule.todos_categories (
 	foreign key (category) references schedule.categories(pk)
 );
 
+create table schedule.reminders (
+	todo int not null,
+	person int not null,
+	threshold varchar(16) not null,
+	sent timestamp not null default current_timestamp,
+	primary key(todo, person, threshold),
+	foreign key(todo) references schedule.todos(pk),
+	foreign key(person) references usoc.persons(pk),
+	constraint reminders_threshold check (threshold in ('soon', 'overdue'))
+);
+
+create table schedule.todos_links (
+	todo int not null,
+	kind varchar(16) not null,
+	ref int not null,
+	primary key(todo, kind, ref),
+	foreign key(todo) references schedule.todos(pk),
+	constraint todos_links_kind check (kind in ('event', 'file', 'slot', 'uplink'))
+);
+
 create table revisions.todos (
 	like schedule.todos INCLUDING DEFAULTS,
 	assignees text[],
 	categories text[]
 );
 
+create table schedule.templates (
+	pk serial not null,
+	name varchar(256) not null,
+	summary text,
+	steps json not null,
+	person int not null,
+	lastmod timestamp not null default current_timestamp,
+	canceled bool not null default false,
+	primary key(pk),
+	foreign key(person) references usoc.persons(pk),
+	constraint templates_name_unique unique(name),
+	constraint templates_name_length check(length(name)>0)
+);
+
 create table schedule.journals (
 	pk serial not null,
 	day timestamp not null default current_timestamp,
@@ -228,10 +280,92 @@ create table schedule.journals (
 	lastmod timestamp not null default current_timestamp,
 	person int not null,
 	canceled bool not null default false,
+	signoff varchar(16) not null default 'draft',
+	approver int,
+	approved timestamp,
+	primary key(pk),
+	foreign key(person) references usoc.persons(pk),
+	foreign key(approver) references usoc.persons(pk),
+	constraint journals_signoff check (signoff in ('draft', 'submitted', 'approved', 'locked'))
+);
+
+create table schedule.journals_addenda (
+	pk serial not null,
+	journal int not null,
+	body text not null,
+	person int not null,
+	lastmod timestamp not null default current_timestamp,
 	primary key(pk),
+	foreign key(journal) references schedule.journals(pk),
 	foreign key(person) references usoc.persons(pk)
 );
 
+create table schedule.incidents (
+	pk serial not null,
+	summary varchar(1024) not null,
+	description text,
+	severity varchar(16) not null default 'minor',
+	state varchar(16) not null default 'open',
+	detected timestamp not null default current_timestamp,
+	event int,
+	meta json,
+	person int not null,
+	lastmod timestamp not null default current_timestamp,
+	canceled bool not null default false,
+	primary key(pk),
+	foreign key(event) references schedule.events(pk),
+	foreign key(person) references usoc.persons(pk),
+	constraint incidents_severity check (severity in ('minor', 'major', 'critical')),
+	constraint incidents_state check (state in ('open', 'investigating', 'resolved', 'closed'))
+);
+
+create table schedule.incidents_categories (
+	incident int not null,
+	category int not null,
+	primary key(incident, category),
+	foreign key(incident) references schedule.incidents(pk),
+	foreign key(category) references schedule.categories(pk)
+);
+
+create table schedule.incidents_slots (
+	incident int not null,
+	slot int not null,
+	primary key(incident, slot),
+	foreign key(incident) references schedule.incidents(pk),
+	foreign key(slot) references schedule.slots(pk)
+);
+
+create table schedule.incidents_journals (
+	incident int not null,
+	journal int not null,
+	primary key(incident, journal),
+	foreign key(incident) references schedule.incidents(pk),
+	foreign key(journal) references schedule.journals(pk)
+);
+
+create table revisions.incidents (
+	like schedule.incidents INCLUDING DEFAULTS,
+	categories text[],
+	slots int[]
+);
+
+create table schedule.journals_files (
+	journal int not null,
+	file int not null,
+	primary key(journal, file),
+	foreign key(journal) references schedule.journals(pk),
+	foreign key(file) references schedule.files(pk)
+);
+
+create table schedule.journals_links (
+	journal int not null,
+	kind varchar(16) not null,
+	ref int not null,
+	primary key(journal, kind, ref),
+	foreign key(journal) references schedule.journals(pk),
+	constraint journals_links_kind check (kind in ('event', 'uplink', 'transfer', 'todo'))
+);
+
 create table schedule.journals_categories (
 	journal int not null,
 	category int not null,
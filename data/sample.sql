@@ -87,7 +87,15 @@ insert into schedule.slots(pk, name, category, person) values
   (318615001, 's-asim-0', 3, 1),
   (318615002, 's-asim-1', 3, 1);
 
-insert into schedule.files(name, content, person) values
+insert into schedule.files(name, content, length, sum, digest, person)
+  select
+    v.name,
+    v.content,
+    coalesce(length(v.content), 0),
+    coalesce(md5(v.content), ''),
+    encode(digest(v.content, 'sha256'), 'hex'),
+    v.person
+  from (values
   ('f-solar-0.bin', convert_to('solar-0', 'UTF8'), 1),
   ('f-solar-1.bin', convert_to('solar-1', 'UTF8'), 1),
   ('f-solar-2.dat', convert_to('solar-2', 'UTF8'), 1),
@@ -103,7 +111,7 @@ insert into schedule.files(name, content, person) values
   ('d-dummy-0', null, 1),
   ('d-dummy-1', null, 1),
   ('d-dummy-2', null, 1),
-  ('d-dummy-3', null, 1);
+  ('d-dummy-3', null::bytea, 1)) v(name, content, person);
 
 insert into schedule.files_categories (file, category) values
   (1, 1), -- solar-0
@@ -1,9 +1,13 @@
 drop function if exists updateFiles() cascade;
 drop function if exists updateTodos() cascade;
 drop function if exists updateEvents() cascade;
+drop function if exists updateIncidents() cascade;
 
 create function updateJournals() returns trigger as $auditJournals$
 	begin
+		if OLD.signoff = 'locked' then
+			raise exception 'journal is locked';
+		end if;
 		insert into revisions.journals
 			select
 				OLD.pk,
@@ -14,6 +18,9 @@ create function updateJournals() returns trigger as $auditJournals$
 				OLD.lastmod,
 				OLD.person,
 				OLD.canceled,
+				OLD.signoff,
+				OLD.approver,
+				OLD.approved,
 				v.categories
 			from vjournals v
 				where v.pk=OLD.pk;
@@ -81,7 +88,7 @@ $auditEvents$ language plpgsql;
 
 create function updateFiles() returns trigger as $auditFiles$
 	begin
-		if OLD.content != NEW.content then
+		if OLD.content != NEW.content or OLD.digest != NEW.digest then
 			raise exception 'content is frozen';
 		end if;
 		insert into revisions.files
@@ -103,6 +110,32 @@ create function updateFiles() returns trigger as $auditFiles$
 	end;
 $auditFiles$ language plpgsql;
 
+create function updateIncidents() returns trigger as $auditIncidents$
+	begin
+		insert into revisions.incidents
+			select
+				OLD.pk,
+				OLD.summary,
+				OLD.description,
+				OLD.severity,
+				OLD.state,
+				OLD.detected,
+				OLD.event,
+				OLD.meta,
+				OLD.person,
+				OLD.lastmod,
+				OLD.canceled,
+				v.categories,
+				v.slots
+			from vincidents v
+			where v.pk=OLD.pk;
+		delete from schedule.incidents_categories where incident=OLD.pk;
+		delete from schedule.incidents_slots where incident=OLD.pk;
+		return NEW;
+	end;
+$auditIncidents$ language plpgsql;
+
+drop trigger if exists trackIncidents on schedule.incidents;
 drop trigger if exists trackFiles on schedule.files;
 drop trigger if exists trackEvents on schedule.events;
 drop trigger if exists trackTodos on schedule.todos;
@@ -131,3 +164,9 @@ create trigger trackFiles
 	for each row
 	when (not OLD.canceled or OLD.parent is null)
 	execute procedure updateFiles();
+
+create trigger trackIncidents
+	before update on schedule.incidents
+	for each row
+	when (not OLD.canceled)
+	execute procedure updateIncidents();
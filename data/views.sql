@@ -3,18 +3,24 @@ drop view if exists vfiles cascade;
 drop view if exists vevents cascade;
 drop view if exists vtodos cascade;
 drop view if exists vuplinks cascade;
+drop view if exists vuplinkshistory cascade;
 drop view if exists vdownlinks cascade;
 drop view if exists vtransfers cascade;
 drop view if exists vcategories cascade;
 drop view if exists vusers cascade;
 drop view if exists vjournals cascade;
+drop view if exists voccupancies cascade;
+drop view if exists vtemplates cascade;
 
+drop view if exists vincidents cascade;
+
+drop view if exists revisions.vincidents cascade;
 drop view if exists revisions.vfiles cascade;
 drop view if exists revisions.vtodos cascade;
 drop view if exists revisions.vevents cascade;
 drop view if exists revisions.vrevisions cascade;
 
-create or replace view vjournals(pk, day, summary, meta, state, lastmod, person, categories) as
+create or replace view vjournals(pk, day, summary, meta, state, lastmod, person, categories, signoff, approver, approved) as
 	with cs(pk, vs) as (
 		select
 			j.journal,
@@ -33,10 +39,14 @@ create or replace view vjournals(pk, day, summary, meta, state, lastmod, person,
 		j.state,
 		j.lastmod,
 		p.initial,
-		coalesce(c.vs, '{}'::text[])
+		coalesce(c.vs, '{}'::text[]),
+		j.signoff,
+		coalesce(a.initial, ''),
+		j.approved
 	from
 		schedule.journals j
 		join usoc.persons p on j.person=p.pk
+		left outer join usoc.persons a on j.approver=a.pk
 		left outer join cs c on j.pk=c.pk
 	where
 		not j.canceled;
@@ -66,19 +76,35 @@ create or replace view vusers(pk, firstname, lastname, initial, email, internal,
 	where
 		passwd is not null;
 
-create or replace view vcategories(pk, name, person, lastmod) as
+create or replace view vcategories(pk, name, person, lastmod, checksum, parent, archived) as
 	select
 		c.pk,
 		c.name,
 		coalesce(p.initial, 'gpt'),
-		c.lastmod
+		c.lastmod,
+		coalesce(c.checksum, ''),
+		coalesce(c.parent, 0),
+		c.archived
 	from schedule.categories c
 		left outer join usoc.persons p on c.person=p.pk
 	where
 		not c.canceled;
 
-create or replace view vtodos(pk, summary, description, state, priority, person, version, meta, categories, assignees, due, dtstart, dtend, lastmod, parent) as
+create or replace view vtodos(pk, summary, description, state, priority, person, version, meta, categories, assignees, due, dtstart, dtend, lastmod, parent, progress) as
 	with
+		ds(pk, progress) as (
+			select
+				t.parent,
+				(100*count(t.pk) filter (where t.state='completed'))/count(t.pk)
+			from
+				schedule.todos t
+			where
+				t.parent is not null
+				and not t.canceled
+				and t.state<>'canceled'
+			group by
+				t.parent
+		),
 		ps(pk, vs) as (
 			select
 				a.todo,
@@ -123,17 +149,33 @@ create or replace view vtodos(pk, summary, description, state, priority, person,
 		t.dtstart,
 		t.dtend,
 		t.lastmod,
-		t.parent
+		t.parent,
+		coalesce(ds.progress, case when t.state='completed' then 100 else 0 end)
 	from
 		schedule.todos t
 		join usoc.persons p on t.person=p.pk
+		left outer join ds on ds.pk=t.pk
 		left outer join rs on rs.pk=t.pk
 		left outer join cs on cs.pk=t.pk
 		left outer join ps on ps.pk=t.pk
 	where
 		not t.canceled;
 
-create or replace view vslots(sid, name, person, category, lastmod, state, file) as
+create or replace view vtemplates(pk, name, summary, steps, person, lastmod) as
+	select
+		t.pk,
+		t.name,
+		coalesce(t.summary, ''),
+		t.steps,
+		p.initial,
+		t.lastmod
+	from
+		schedule.templates t
+		join usoc.persons p on t.person=p.pk
+	where
+		not t.canceled;
+
+create or replace view vslots(sid, name, person, category, lastmod, state, file, checksum) as
 	with
 		us(pk) as (
 			select
@@ -149,7 +191,8 @@ create or replace view vslots(sid, name, person, category, lastmod, state, file)
 		c.name,
 		coalesce(u.lastmod, s.lastmod),
 		coalesce(u.state, 'n/a'),
-		coalesce(f.name, '')
+		coalesce(f.name, ''),
+		coalesce(c.checksum, '')
 	from
 		schedule.slots s
 		join schedule.categories c on s.category=c.pk
@@ -159,7 +202,43 @@ create or replace view vslots(sid, name, person, category, lastmod, state, file)
 	where
 		not s.canceled;
 
-create or replace view vfiles(pk, version, name, crc, summary, meta, person, lastmod, superseeded, original, length, sum, categories, slot, location) as
+create or replace view voccupancies(slot, name, category, uplink, file, filename, state, dtstart, dtend) as
+	with
+		us(pk, slot, file, state, dtstamp) as (
+			select
+				u.pk,
+				u.slot,
+				u.file,
+				u.state,
+				coalesce(e.rtstart, e.dtstart)
+			from
+				schedule.uplinks u
+				join schedule.events e on u.event=e.pk
+				join schedule.files f on u.file=f.pk
+			where
+				not e.canceled
+				and u.state not in ('canceled', 'aborted')
+				and f.length>0
+	)
+	select
+		s.pk,
+		s.name,
+		c.name,
+		u.pk,
+		u.file,
+		f.name,
+		u.state,
+		u.dtstamp,
+		lead(u.dtstamp) over (partition by u.slot order by u.dtstamp, u.pk)
+	from
+		us u
+		join schedule.slots s on u.slot=s.pk
+		join schedule.categories c on s.category=c.pk
+		join schedule.files f on u.file=f.pk
+	where
+		not s.canceled;
+
+create or replace view vfiles(pk, version, name, crc, summary, meta, person, lastmod, superseeded, original, length, sum, categories, slot, location, checksums) as
 	with
 		cs(pk, vs) as (
 				select
@@ -169,6 +248,13 @@ create or replace view vfiles(pk, version, name, crc, summary, meta, person, las
 					schedule.files_categories f
 					join schedule.categories c on f.category=c.pk
 				group by f.file
+		), ks(pk, vs) as (
+				select
+					k.file,
+					json_object_agg(k.algorithm, k.value)
+				from
+					schedule.files_checksums k
+				group by k.file
 		), rs(pk, version) as (
 				select
 					f.pk,
@@ -199,8 +285,8 @@ create or replace view vfiles(pk, version, name, crc, summary, meta, person, las
     --   else exists(select v.pk from schedule.files v where v.pk=f.parent)
     -- end,
 		f.parent is null,
-		coalesce(length(f.content), 0),
-		coalesce(md5(f.content), ''),
+		f.length,
+		f.sum,
 		coalesce(cs.vs, '{}'::varchar[]),
 		case
 			when u.slot is not null and u.state='completed' then s.name
@@ -208,14 +294,16 @@ create or replace view vfiles(pk, version, name, crc, summary, meta, person, las
 		end,
 		case
 			when t.pk is not null and t.state='completed' then t.location
-			when t.pk is null and f.content is null then '/'
+			when t.pk is null and f.digest is null then '/'
 			else ''
-		end
+		end,
+		coalesce(ks.vs, '{}'::json)
 	from
 		schedule.files f
 		join usoc.persons p on f.person=p.pk
 		left outer join rs on rs.pk=f.pk
 		left outer join cs on cs.pk=f.pk
+		left outer join ks on ks.pk=f.pk
 		left outer join (select * from schedule.uplinks where pk in (select pk from us))u on f.pk=u.file
 		left outer join schedule.slots s on u.slot=s.pk
 		left outer join schedule.transfers t on u.pk=t.uplink
@@ -259,8 +347,8 @@ create or replace view vevents(pk, source, summary, description, meta, state, ve
 		coalesce(rs.count+1, 1),
 		e.dtstart,
 		e.dtend,
-		coalesce(e.rtstart, e.dtstart),
-		coalesce(e.rtend, e.dtend),
+		e.rtstart,
+		e.rtend,
 		coalesce(i.categories, '{}'::text[]),
 		coalesce(p.initial, 'gpt'),
 		coalesce(a.persons, '{}'::text[]),
@@ -275,7 +363,7 @@ create or replace view vevents(pk, source, summary, description, meta, state, ve
 	where
 		not e.canceled;
 
-create or replace view vuplinks(pk, dropbox, state, person, lastmod, event, file, slot, dtstamp, category) as
+create or replace view vuplinkshistory(pk, dropbox, state, person, lastmod, event, file, slot, dtstamp, category) as
 	select
 		u.pk,
 		concat_ws('_', 'S', u.slot, upper(regexp_replace(s.name, '\.', '_')), upper(split_part(f.name, '.', 1)), to_char(e.dtstart, 'YY_DDD_HH24_MI')),
@@ -291,10 +379,16 @@ create or replace view vuplinks(pk, dropbox, state, person, lastmod, event, file
 		schedule.uplinks u
 		join schedule.events e on u.event=e.pk
 		join usoc.persons p on u.person=p.pk
-		join (select pk, name from schedule.files f where f.content is not null and length(f.content)>0) f on u.file=f.pk
-		join vslots s on u.slot=s.sid
+		join (select pk, name from schedule.files f where f.length>0) f on u.file=f.pk
+		join vslots s on u.slot=s.sid;
+
+create or replace view vuplinks(pk, dropbox, state, person, lastmod, event, file, slot, dtstamp, category) as
+	select
+		pk, dropbox, state, person, lastmod, event, file, slot, dtstamp, category
+	from
+		vuplinkshistory
 	where
-		u.pk in (select max(pk) from schedule.uplinks group by(slot));
+		pk in (select max(pk) from schedule.uplinks group by(slot));
 
 -- create or replace view vuplinks(pk, dropbox, state, person, lastmod, event, file, slot, dtstamp, category) as
 -- 	select
@@ -332,7 +426,7 @@ create or replace view vdownlinks(pk, state, person, lastmod, event, file, slot,
 		schedule.uplinks u
 		join (select * from schedule.events e where not e.canceled) e on u.event=e.pk
 		join usoc.persons p on u.person=p.pk
-		join (select pk from schedule.files f where not f.canceled and (f.content is not null or length(f.content)>0)) f on u.file=f.pk
+		join (select pk from schedule.files f where not f.canceled and (f.digest is not null or f.length>0)) f on u.file=f.pk
 		join vslots s on u.slot=s.sid;
 
 create or replace view vtransfers(pk, state, person, lastmod, location, event, uplink, slot, file, dtstamp, category) as
@@ -355,7 +449,79 @@ create or replace view vtransfers(pk, state, person, lastmod, location, event, u
 		join usoc.persons p on t.person=p.pk;
 
 
-create or replace view revisions.vjournals(pk, version, day, summary, meta, state, lastmod, person, categories) as
+create or replace view vincidents(pk, summary, description, severity, state, detected, event, meta, person, lastmod, version, categories, slots, journals) as
+	with cs(incident, categories) as (
+		select
+			i.incident,
+			array_agg(c.name)
+		from schedule.incidents_categories i
+			join schedule.categories c on i.category=c.pk
+		group by i.incident
+	), ss(incident, slots) as (
+		select
+			incident,
+			array_agg(slot order by slot)
+		from schedule.incidents_slots
+		group by incident
+	), js(incident, journals) as (
+		select
+			i.incident,
+			array_agg(i.journal order by j.day)
+		from schedule.incidents_journals i
+			join schedule.journals j on i.journal=j.pk
+		where not j.canceled
+		group by i.incident
+	), rs(incident, count) as (
+		select
+			pk,
+			count(pk)
+		from revisions.incidents
+		group by pk
+	)
+	select
+		i.pk,
+		i.summary,
+		coalesce(i.description, ''),
+		i.severity,
+		i.state,
+		i.detected,
+		coalesce(i.event, 0),
+		i.meta,
+		p.initial,
+		i.lastmod,
+		coalesce(rs.count+1, 1),
+		coalesce(cs.categories, '{}'::text[]),
+		coalesce(ss.slots, '{}'::int[]),
+		coalesce(js.journals, '{}'::int[])
+	from schedule.incidents i
+		join usoc.persons p on i.person=p.pk
+		left outer join cs on i.pk=cs.incident
+		left outer join ss on i.pk=ss.incident
+		left outer join js on i.pk=js.incident
+		left outer join rs on i.pk=rs.incident
+	where
+		not i.canceled;
+
+create or replace view revisions.vincidents(pk, summary, description, severity, state, detected, event, meta, person, lastmod, version, categories, slots, journals) as
+	select
+		i.pk,
+		i.summary,
+		coalesce(i.description, ''),
+		i.severity,
+		i.state,
+		i.detected,
+		coalesce(i.event, 0),
+		i.meta,
+		p.initial,
+		i.lastmod,
+		row_number() over (partition by i.pk order by i.lastmod),
+		coalesce(i.categories, '{}'::text[]),
+		coalesce(i.slots, '{}'::int[]),
+		'{}'::int[]
+	from revisions.incidents i
+		join usoc.persons p on i.person=p.pk;
+
+create or replace view revisions.vjournals(pk, version, day, summary, meta, state, lastmod, person, categories, signoff, approver, approved) as
 	select
 		j.pk,
 		row_number() over (partition by j.pk order by j.lastmod),
@@ -365,9 +531,13 @@ create or replace view revisions.vjournals(pk, version, day, summary, meta, stat
 		j.state,
 		j.lastmod,
 		p.initial,
-		coalesce(j.categories, '{}'::text[])
+		coalesce(j.categories, '{}'::text[]),
+		j.signoff,
+		coalesce(a.initial, ''),
+		j.approved
 	from revisions.journals j
-	join usoc.persons p on j.person=p.pk;
+	join usoc.persons p on j.person=p.pk
+	left outer join usoc.persons a on j.approver=a.pk;
 
 create or replace view revisions.vevents(pk, source, summary, description, meta, state, version, dtstart, dtend, rtstart, rtend, person, attendees, categories, lastmod) as
 	select
@@ -380,8 +550,8 @@ create or replace view revisions.vevents(pk, source, summary, description, meta,
 		row_number() over (partition by e.pk order by e.lastmod),
 		e.dtstart,
 		e.dtend,
-		coalesce(e.rtstart, e.dtstart),
-		coalesce(e.rtend, e.dtend),
+		e.rtstart,
+		e.rtend,
 		p.initial,
 		e.attendees,
 		e.categories,
@@ -410,7 +580,7 @@ create or replace view revisions.vtodos(pk, summary, description, state, priorit
 		revisions.todos t
 		join usoc.persons p on t.person=p.pk;
 
-create or replace view revisions.vfiles(pk, name, slot, location, summary, categories, meta, version, length, sum, superseeded, person, lastmod) as
+create or replace view revisions.vfiles(pk, name, slot, location, summary, categories, meta, version, length, sum, superseeded, person, lastmod, checksums) as
 	select
 		f.pk,
 		f.name,
@@ -420,11 +590,12 @@ create or replace view revisions.vfiles(pk, name, slot, location, summary, categ
 		f.categories,
 		f.meta,
 		row_number() over(partition by f.pk order by f.lastmod),
-		coalesce(length(s.content), 0),
-		coalesce(md5(s.content), ''),
+		s.length,
+		s.sum,
 		s.parent is null,
 		p.initial,
-		f.lastmod
+		f.lastmod,
+		coalesce((select json_object_agg(k.algorithm, k.value) from schedule.files_checksums k where k.file=f.pk), '{}'::json)
 	from
 		revisions.files f
 		join schedule.files s on f.pk=s.pk
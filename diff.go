@@ -0,0 +1,300 @@
+package hourglass
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+)
+
+const DiffContext = 3
+
+const (
+	// MaxDiffSize is the size of the largest content for which a unified diff
+	// is computed.
+	MaxDiffSize = 1 << 20
+	// MaxDiffEdits is the maximum number of inserted and deleted lines of a
+	// unified diff. It bounds the memory used to compute it.
+	MaxDiffEdits = 2000
+)
+
+type Diff struct {
+	Source  int          `json:"source"`
+	Target  int          `json:"target"`
+	Binary  bool         `json:"binary"`
+	Unified string       `json:"diff,omitempty"`
+	Summary *DiffSummary `json:"summary,omitempty"`
+	// Reason explains why only a summary is given for text contents.
+	Reason string `json:"reason,omitempty"`
+}
+
+// DiffSummary describes the differences between two binary contents.
+type DiffSummary struct {
+	SourceLength int    `json:"source_length"`
+	TargetLength int    `json:"target_length"`
+	SourceSum    string `json:"source_sum"`
+	TargetSum    string `json:"target_sum"`
+	Changed      int    `json:"changed"`
+	Offset       int    `json:"offset"`
+}
+
+// DiffFiles compares the content of two files. A unified diff is computed when
+// both contents are text, are not larger than MaxDiffSize and differ by at
+// most MaxDiffEdits lines. Otherwise only a summary of the changed bytes is
+// given, computed without loading the contents in memory.
+func DiffFiles(db *sql.DB, id, other int) (*Diff, error) {
+	src, a, err := OpenFile(db, id)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	dst, b, err := OpenFile(db, other)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+
+	d := Diff{Source: src.Id, Target: dst.Id}
+	if src.Length > MaxDiffSize || dst.Length > MaxDiffSize {
+		d.Reason = "content too large"
+		return summarizeDiff(&d, src, dst, a, b)
+	}
+	x, err := ioutil.ReadAll(a)
+	if err != nil {
+		return nil, err
+	}
+	y, err := ioutil.ReadAll(b)
+	if err != nil {
+		return nil, err
+	}
+	if !isText(x) || !isText(y) {
+		d.Binary = true
+		return summarizeDiff(&d, src, dst, bytes.NewReader(x), bytes.NewReader(y))
+	}
+	es, ok := diffLines(splitLines(x), splitLines(y))
+	if !ok {
+		d.Reason = "too many differences"
+		return summarizeDiff(&d, src, dst, bytes.NewReader(x), bytes.NewReader(y))
+	}
+	from := fmt.Sprintf("%s (%d)", src.Name, src.Id)
+	to := fmt.Sprintf("%s (%d)", dst.Name, dst.Id)
+	d.Unified = unifiedDiff(from, to, es)
+	return &d, nil
+}
+
+func summarizeDiff(d *Diff, src, dst *File, a, b io.Reader) (*Diff, error) {
+	s, err := diffBytes(a, b)
+	if err != nil {
+		return nil, err
+	}
+	s.SourceSum, s.TargetSum = src.Sum, dst.Sum
+	d.Summary = s
+	return d, nil
+}
+
+func isText(bs []byte) bool {
+	return utf8.Valid(bs) && bytes.IndexByte(bs, 0) < 0
+}
+
+func splitLines(bs []byte) []string {
+	if len(bs) == 0 {
+		return nil
+	}
+	s := strings.TrimSuffix(string(bs), "\n")
+	return strings.Split(s, "\n")
+}
+
+func diffBytes(a, b io.Reader) (*DiffSummary, error) {
+	var (
+		s  = DiffSummary{Offset: -1}
+		ra = bufio.NewReader(a)
+		rb = bufio.NewReader(b)
+	)
+	for i := 0; ; i++ {
+		x, errx := ra.ReadByte()
+		y, erry := rb.ReadByte()
+		if errx != nil && errx != io.EOF {
+			return nil, errx
+		}
+		if erry != nil && erry != io.EOF {
+			return nil, erry
+		}
+		if errx == io.EOF && erry == io.EOF {
+			break
+		}
+		if errx == nil {
+			s.SourceLength++
+		}
+		if erry == nil {
+			s.TargetLength++
+		}
+		if errx == nil && erry == nil && x == y {
+			continue
+		}
+		if s.Offset < 0 {
+			s.Offset = i
+		}
+		s.Changed++
+	}
+	return &s, nil
+}
+
+const (
+	opEqual byte = ' '
+	opDel   byte = '-'
+	opIns   byte = '+'
+)
+
+type edit struct {
+	op   byte
+	line string
+	// position of the line in the source (for equal and del) and in the
+	// target (for equal and ins).
+	src, dst int
+}
+
+// diffLines gives the shortest edit script to transform a into b following
+// the algorithm of E. Myers, "An O(ND) Difference Algorithm and Its
+// Variations". Only the diagonals reached at each step are kept for the
+// backtracking so that memory grows with the square of the number of edits
+// instead of the size of the inputs. It gives false if more than MaxDiffEdits
+// edits are needed.
+func diffLines(a, b []string) ([]edit, bool) {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil, true
+	}
+	var (
+		off   = max + 1
+		v     = make([]int, 2*max+3)
+		trace [][]int
+	)
+	for d := 0; d <= max && d <= MaxDiffEdits; d++ {
+		trace = append(trace, append([]int(nil), v[off-d-1:off+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace), true
+			}
+		}
+	}
+	return nil, false
+}
+
+func backtrack(a, b []string, trace [][]int) []edit {
+	var (
+		x, y = len(a), len(b)
+		es   []edit
+	)
+	for d := len(trace) - 1; d >= 0; d-- {
+		v, k := trace[d], x-y
+		// v holds the diagonals -d-1 to d+1.
+		at := func(k int) int { return v[k+d+1] }
+
+		var pk int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			pk = k + 1
+		} else {
+			pk = k - 1
+		}
+		px := at(pk)
+		py := px - pk
+		for x > px && y > py {
+			x, y = x-1, y-1
+			es = append(es, edit{op: opEqual, line: a[x], src: x, dst: y})
+		}
+		if d > 0 {
+			if x == px {
+				y--
+				es = append(es, edit{op: opIns, line: b[y], src: x, dst: y})
+			} else {
+				x--
+				es = append(es, edit{op: opDel, line: a[x], src: x, dst: y})
+			}
+		}
+		x, y = px, py
+	}
+	for i, j := 0, len(es)-1; i < j; i, j = i+1, j-1 {
+		es[i], es[j] = es[j], es[i]
+	}
+	return es
+}
+
+func unifiedDiff(from, to string, es []edit) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(es); {
+		if es[i].op == opEqual {
+			i++
+			continue
+		}
+		if buf.Len() == 0 {
+			fmt.Fprintf(&buf, "--- %s\n+++ %s\n", from, to)
+		}
+		// extend the hunk as long as the next change is close enough to share
+		// its context with the current one.
+		start, end := i-DiffContext, i
+		for j := i; j < len(es); j++ {
+			if es[j].op == opEqual {
+				continue
+			}
+			if j-end > 2*DiffContext {
+				break
+			}
+			end = j
+		}
+		end += DiffContext + 1
+		if start < 0 {
+			start = 0
+		}
+		if end > len(es) {
+			end = len(es)
+		}
+		writeHunk(&buf, es[start:end])
+		i = end
+	}
+	return buf.String()
+}
+
+func writeHunk(buf *bytes.Buffer, es []edit) {
+	var (
+		sx, sy = es[0].src, es[0].dst
+		nx, ny int
+	)
+	for _, e := range es {
+		switch e.op {
+		case opEqual:
+			nx, ny = nx+1, ny+1
+		case opDel:
+			nx++
+		case opIns:
+			ny++
+		}
+	}
+	if nx > 0 {
+		sx++
+	}
+	if ny > 0 {
+		sy++
+	}
+	fmt.Fprintf(buf, "@@ -%d,%d +%d,%d @@\n", sx, nx, sy, ny)
+	for _, e := range es {
+		buf.WriteByte(e.op)
+		buf.WriteString(e.line)
+		buf.WriteByte('\n')
+	}
+}
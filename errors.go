@@ -0,0 +1,72 @@
+package hourglass
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	CodeConflict  = "conflict"
+	CodeInvalid   = "invalid"
+	CodeRequired  = "required"
+	CodeReference = "reference"
+	CodeForbidden = "forbidden"
+)
+
+var detail = regexp.MustCompile(`^Key \(([^)]+)\)=\(([^)]*)\)`)
+
+// translate replaces the errors returned by the database by their equivalent
+// Error so that clients get a meaningful message instead of the name of the
+// violated constraint.
+func translate(err *error) {
+	if *err == nil {
+		return
+	}
+	if *err == sql.ErrNoRows {
+		*err = ErrNotFound
+		return
+	}
+	e, ok := (*err).(*pq.Error)
+	if !ok {
+		return
+	}
+	x := Error{
+		Severity: SeverityError,
+		Source:   e.Table,
+		Field:    e.Column,
+	}
+	var value string
+	if ms := detail.FindStringSubmatch(e.Detail); len(ms) == 3 {
+		x.Field, value = ms[1], ms[2]
+	}
+	switch e.Code {
+	case "23505":
+		x.Code = CodeConflict
+		x.Message = fmt.Sprintf("%s %q already exists", x.Field, value)
+	case "23503":
+		x.Code = CodeReference
+		x.Message = fmt.Sprintf("%s %q does not exist", x.Field, value)
+	case "23502":
+		x.Code = CodeRequired
+		x.Message = fmt.Sprintf("%s is missing or unknown", x.Field)
+	case "23514":
+		x.Code = CodeInvalid
+		if x.Field == "" {
+			x.Field = strings.TrimPrefix(e.Constraint, e.Table+"_")
+			if i := strings.LastIndexByte(x.Field, '_'); i > 0 {
+				x.Field = x.Field[:i]
+			}
+		}
+		x.Message = fmt.Sprintf("invalid value for %s", x.Field)
+	case "22P02", "22007", "22008", "22023", "P0001":
+		x.Code = CodeInvalid
+		x.Message = e.Message
+	default:
+		return
+	}
+	*err = x
+}
@@ -8,6 +8,8 @@ import (
 	"github.com/lib/pq"
 )
 
+// Event is a planned activity. ExStarts and ExEnds are its actual times: they
+// are zero until recorded and kept by UpdateEvent unless new ones are given.
 type Event struct {
 	Id          int                    `json:"uid"`
 	Summary     string                 `json:"summary"`
@@ -26,6 +28,7 @@ type Event struct {
 	Lastmod     time.Time              `json:"lastmod"`
 	Attachment  *File                  `json:"attachment"`
 	Events      []*Event               `json:"events,omitempty"`
+	Todos       []*Todo                `json:"todos,omitempty"`
 
 	Versions []*Event `json:"history,omitempty"`
 }
@@ -50,6 +53,34 @@ func ListSources(db *sql.DB) ([]string, error) {
 }
 
 func ListEvents(db *sql.DB, f, t time.Time, cs, vs []string) ([]*Event, error) {
+	rs, err := queryEvents(db, f, t, cs, vs)
+	if err != nil {
+		return nil, err
+	}
+	return listEvents(rs)
+}
+
+// WalkEvents calls fn with each of the events given by ListEvents as soon as
+// it is read. It stops at the first error returned by fn.
+func WalkEvents(db *sql.DB, f, t time.Time, cs, vs []string, fn func(*Event) error) error {
+	rs, err := queryEvents(db, f, t, cs, vs)
+	if err != nil {
+		return err
+	}
+	defer rs.Close()
+	for rs.Next() {
+		e, err := scanEvents(rs)
+		if err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rs.Err()
+}
+
+func queryEvents(db *sql.DB, f, t time.Time, cs, vs []string) (*sql.Rows, error) {
 	if f.IsZero() && t.IsZero() {
 		f = time.Now().Truncate(time.Hour * 24)
 		t = f.Add(time.Hour * 24)
@@ -61,11 +92,7 @@ func ListEvents(db *sql.DB, f, t time.Time, cs, vs []string) ([]*Event, error) {
 			(dtstart between $1 and $2 or ($1, $2) overlaps(dtstart, dtend))
 			and case when cardinality($3::varchar[])>0 then categories&&$3::varchar[] else true end
 			and case when cardinality($4::varchar[])>0 then source=any($4) else source='' end`
-	rs, err := db.Query(q, f.UTC(), t.UTC(), pq.StringArray(cs), pq.StringArray(vs))
-	if err != nil {
-		return nil, err
-	}
-	return listEvents(rs)
+	return db.Query(q, f.UTC(), t.UTC(), pq.StringArray(cs), pq.StringArray(vs))
 }
 
 func ViewEvent(db *sql.DB, id int) (*Event, error) {
@@ -100,11 +127,15 @@ func ViewEvent(db *sql.DB, id int) (*Event, error) {
 	if e.Versions, err = listEvents(rs); err != nil {
 		return nil, err
 	}
+	if e.Todos, err = listLinkedTodos(db, LinkEvent, e.Id); err != nil {
+		return nil, err
+	}
 
 	return e, nil
 }
 
-func ImportEvents(db *sql.DB, s string, es []*Event) error {
+func ImportEvents(db *sql.DB, s string, es []*Event) (err error) {
+	defer translate(&err)
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -137,7 +168,8 @@ func ImportEvents(db *sql.DB, s string, es []*Event) error {
 	return tx.Commit()
 }
 
-func NewEvent(db *sql.DB, e *Event) error {
+func NewEvent(db *sql.DB, e *Event) (err error) {
+	defer translate(&err)
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -157,17 +189,16 @@ func NewEvent(db *sql.DB, e *Event) error {
 	return tx.Commit()
 }
 
-func UpdateEvent(db *sql.DB, e *Event) error {
+func UpdateEvent(db *sql.DB, e *Event) (err error) {
+	defer translate(&err)
 	const q = `
 		with
 			u(pk) as (select pk from vusers where initial=$6)
-		update schedule.events set summary=$1, description=$2, dtstart=$3, dtend=$4, meta=$5, person=(select pk from u), state=$7, rtstart=$8, rtend=$9, lastmod=current_timestamp where pk=$10 and source is null returning lastmod`
-	if e.ExStarts.IsZero() {
-		e.ExStarts = e.Starts
-	}
-	if e.ExEnds.IsZero() {
-		e.ExEnds = e.Ends
-	}
+		update schedule.events set summary=$1, description=$2, dtstart=$3, dtend=$4, meta=$5, person=(select pk from u), state=$7, rtstart=coalesce($8, rtstart), rtend=coalesce($9, rtend), lastmod=current_timestamp where pk=$10 and source is null returning lastmod`
+	var (
+		rs = pq.NullTime{Time: e.ExStarts.UTC(), Valid: !e.ExStarts.IsZero()}
+		re = pq.NullTime{Time: e.ExEnds.UTC(), Valid: !e.ExEnds.IsZero()}
+	)
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -177,7 +208,7 @@ func UpdateEvent(db *sql.DB, e *Event) error {
 		tx.Rollback()
 		return err
 	}
-	if err := tx.QueryRow(q, e.Summary, e.Description, e.Starts.UTC(), e.Ends.UTC(), m, e.User, e.State, e.ExStarts.UTC(), e.ExEnds.UTC(), e.Id).Scan(&e.Lastmod); err != nil {
+	if err := tx.QueryRow(q, e.Summary, e.Description, e.Starts.UTC(), e.Ends.UTC(), m, e.User, e.State, rs, re, e.Id).Scan(&e.Lastmod); err != nil {
 		tx.Rollback()
 		return err
 	}
@@ -193,9 +224,10 @@ func UpdateEvent(db *sql.DB, e *Event) error {
 	return tx.Commit()
 }
 
-func DeleteEvent(db *sql.DB, e *Event) error {
+func DeleteEvent(db *sql.DB, e *Event) (err error) {
+	defer translate(&err)
 	const q = `with u(pk) as (select pk from vusers where initial=$2) update schedule.events set canceled=true, person=(select pk from u), lastmod=current_timestamp where pk=$1 and source is null`
-	_, err := db.Exec(q, e.Id, e.User)
+	_, err = db.Exec(q, e.Id, e.User)
 	return err
 }
 
@@ -216,11 +248,12 @@ func listEvents(rs *sql.Rows) ([]*Event, error) {
 func scanEvents(s Scanner) (*Event, error) {
 	var (
 		cs, as pq.StringArray
+		rs, re pq.NullTime
 		m      []byte
 	)
 
 	e := new(Event)
-	if err := s.Scan(&e.Id, &e.Source, &e.Summary, &e.Description, &m, &e.State, &e.Version, &e.Starts, &e.Ends, &e.ExStarts, &e.ExEnds, &e.User, &as, &cs, &e.Lastmod); err != nil {
+	if err := s.Scan(&e.Id, &e.Source, &e.Summary, &e.Description, &m, &e.State, &e.Version, &e.Starts, &e.Ends, &rs, &re, &e.User, &as, &cs, &e.Lastmod); err != nil {
 		return nil, err
 	}
 	if err := json.Unmarshal(m, &e.Meta); err != nil && m != nil {
@@ -229,8 +262,12 @@ func scanEvents(s Scanner) (*Event, error) {
 
 	e.Starts = e.Starts.UTC()
 	e.Ends = e.Ends.UTC()
-	e.ExStarts = e.ExStarts.UTC()
-	e.ExEnds = e.ExEnds.UTC()
+	if rs.Valid {
+		e.ExStarts = rs.Time.UTC()
+	}
+	if re.Valid {
+		e.ExEnds = re.Time.UTC()
+	}
 	e.Categories = []string(cs)
 	e.Attendees = []string(as)
 
@@ -252,13 +289,10 @@ func createEvent(tx *sql.Tx, e *Event) error {
 }
 
 func linkEvent2Categories(tx *sql.Tx, e *Event) error {
-	const (
-		r = `insert into schedule.categories(name) values($1) on conflict(name) do update set name=$1 returning pk`
-		s = `insert into schedule.events_categories(event, category) values($1, $2) on conflict do nothing`
-	)
+	const s = `insert into schedule.events_categories(event, category) values($1, $2) on conflict do nothing`
 	for _, c := range e.Categories {
-		var cid int
-		if err := tx.QueryRow(r, c).Scan(&cid); err != nil {
+		cid, err := lookupCategory(tx, c)
+		if err != nil {
 			return err
 		}
 		if _, err := tx.Exec(s, e.Id, cid); err != nil {
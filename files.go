@@ -1,11 +1,16 @@
 package hourglass
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"os"
 	"time"
 
 	"github.com/lib/pq"
@@ -24,6 +29,7 @@ type File struct {
 	Length     int                    `json:"length"`
 	Sum        string                 `json:"sum"`
 	Cyclic     uint16                 `json:"crc"`
+	Checksums  map[string]string      `json:"checksums"`
 
 	Dummy       bool `json:"dummy"`
 	Superseeded bool `json:"superseeded"`
@@ -37,12 +43,113 @@ type File struct {
 
 	Versions []*File `json:"history,omitempty"`
 	Parents  []*File `json:"parents,omitempty"`
+	Warnings []Error `json:"warnings,omitempty"`
+
+	// spool keeps the content read by ReadFrom until the file is created.
+	spool  *os.File
+	digest string
+}
+
+// ReadFrom reads the content of f from r. Instead of being kept in Content,
+// the content is copied to a temporary file while its length and its checksums
+// are computed. Release should be called once f has been created.
+func (f *File) ReadFrom(r io.Reader) (int64, error) {
+	if err := f.Release(); err != nil {
+		return 0, err
+	}
+	w, err := ioutil.TempFile("", "hourglass-")
+	if err != nil {
+		return 0, err
+	}
+	m := newMeasurer()
+	n, err := io.Copy(io.MultiWriter(w, m), r)
+	if err != nil {
+		w.Close()
+		os.Remove(w.Name())
+		return n, err
+	}
+	f.spool, f.Content = w, nil
+	m.update(f)
+	return n, nil
+}
+
+// Release removes the temporary file created by ReadFrom.
+func (f *File) Release() error {
+	if f.spool == nil {
+		return nil
+	}
+	f.spool.Close()
+	err := os.Remove(f.spool.Name())
+	f.spool, f.digest = nil, ""
+	return err
+}
+
+// Reader gives the content of f, whether it is given in Content or has been
+// read by ReadFrom.
+func (f *File) Reader() io.Reader {
+	if f.spool != nil {
+		return io.NewSectionReader(f.spool, 0, int64(f.Length))
+	}
+	return bytes.NewReader(f.Content)
+}
+
+// measure computes the length and the checksums of Content unless they are
+// already known.
+func (f *File) measure() {
+	if f.spool != nil || f.digest != "" {
+		return
+	}
+	if f.Content == nil {
+		f.Length, f.Sum, f.Cyclic, f.Checksums = 0, "", CITT, nil
+		return
+	}
+	m := newMeasurer()
+	m.Write(f.Content)
+	m.update(f)
+}
+
+// measurer computes in a single pass all the properties of a content.
+type measurer struct {
+	length  int
+	crc     *crc16
+	md5     hash.Hash
+	sha256  hash.Hash
+	hashes  map[string]hash.Hash
+	writers io.Writer
+}
+
+func newMeasurer() *measurer {
+	m := measurer{
+		crc:    newCRC16(),
+		md5:    md5.New(),
+		sha256: sha256.New(),
+		hashes: newChecksums(),
+	}
+	ws := []io.Writer{m.crc, m.md5, m.sha256}
+	for _, h := range m.hashes {
+		ws = append(ws, h)
+	}
+	m.writers = io.MultiWriter(ws...)
+	return &m
+}
+
+func (m *measurer) Write(bs []byte) (int, error) {
+	m.length += len(bs)
+	return m.writers.Write(bs)
+}
+
+func (m *measurer) update(f *File) {
+	f.Length = m.length
+	f.Cyclic = m.crc.Sum16()
+	f.Sum = fmt.Sprintf("%x", m.md5.Sum(nil))
+	f.digest = fmt.Sprintf("%x", m.sha256.Sum(nil))
+	f.Checksums = sumChecksums(m.hashes)
 }
 
 func ListFiles(db *sql.DB, which string, cs []string) ([]*File, error) {
 	const q = `
 select
-	pk, name, crc, slot, location, summary, categories, meta, version, length, sum, superseeded, original, person, lastmod
+	pk, name, crc, slot, location, summary, categories, meta, version, length, sum, superseeded, original, person, lastmod, checksums
 from vfiles
 	where case when cardinality($1::varchar[])>0 then categories&&$1::varchar[] else true end
 		and case when $2='latest' then not superseeded when $2='origin' then original else true end`
@@ -68,9 +175,8 @@ from vfiles
 
 func ViewFile(db *sql.DB, id int, raw, parent bool) (*File, error) {
 	const (
-		q = `select pk, name, crc, slot, location, summary, categories, meta, version, length, sum, superseeded, original, person, lastmod from vfiles where pk=$1`
-		c = `select content from schedule.files where pk=$1 and content is not null and length(content) > 0`
-		v = `select pk, name, 0 as crc, slot, location, summary, categories, meta, version, length, sum, superseeded, false, person, lastmod from revisions.vfiles where pk=$1`
+		q = `select pk, name, crc, slot, location, summary, categories, meta, version, length, sum, superseeded, original, person, lastmod, checksums from vfiles where pk=$1`
+		v = `select pk, name, 0 as crc, slot, location, summary, categories, meta, version, length, sum, superseeded, false, person, lastmod, checksums from revisions.vfiles where pk=$1`
 	)
 	f, err := scanFiles(db.QueryRow(q, id))
 	switch err {
@@ -80,8 +186,14 @@ func ViewFile(db *sql.DB, id int, raw, parent bool) (*File, error) {
 		return nil, ErrNotFound
 	case nil:
 	}
-	if raw {
-		if err := db.QueryRow(c, id).Scan(&f.Content); err != nil && f.Length > 0 {
+	if raw && f.Length > 0 {
+		c, err := Store.Open(db, id)
+		if err != nil {
+			return nil, err
+		}
+		f.Content, err = ioutil.ReadAll(c)
+		c.Close()
+		if err != nil {
 			return nil, err
 		}
 	}
@@ -106,11 +218,30 @@ func ViewFile(db *sql.DB, id int, raw, parent bool) (*File, error) {
 	return f, nil
 }
 
+// OpenFile gives the metadata of a file and a reader on its content. The
+// reader should be closed by the caller.
+func OpenFile(db *sql.DB, id int) (*File, Content, error) {
+	const q = `select pk, name, crc, slot, location, summary, categories, meta, version, length, sum, superseeded, original, person, lastmod, checksums from vfiles where pk=$1`
+	f, err := scanFiles(db.QueryRow(q, id))
+	switch err {
+	default:
+		return nil, nil, err
+	case sql.ErrNoRows:
+		return nil, nil, ErrNotFound
+	case nil:
+	}
+	c, err := Store.Open(db, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, c, nil
+}
+
 func listParents(db *sql.DB, id int) []*File {
 	const q = `with recursive others(pk, parent) as
 		(select pk, parent from schedule.files where parent is not null union select all fs.pk, rs.parent from schedule.files fs join others rs on rs.pk=fs.parent),
 		list(pk) as (select parent from others where pk=$1)
-	select pk, name, crc, slot, location, summary, categories, meta, version, length, sum, superseeded, original, person, lastmod from vfiles where pk in (select pk from list);
+	select pk, name, crc, slot, location, summary, categories, meta, version, length, sum, superseeded, original, person, lastmod, checksums from vfiles where pk in (select pk from list);
 	`
 	rs, err := db.Query(q, id)
 	if err != nil {
@@ -129,7 +260,87 @@ func listParents(db *sql.DB, id int) []*File {
 	return fs
 }
 
-func NewFile(db *sql.DB, f *File) error {
+type Lineage struct {
+	*File     `json:"file"`
+	Ancestors []*File `json:"ancestors"`
+	Children  []*Node `json:"children"`
+}
+
+type Node struct {
+	*File    `json:"file"`
+	Children []*Node `json:"children,omitempty"`
+}
+
+// ViewLineage gives the ancestors of a file, from the original to its direct
+// parent, and the tree of all its descendants.
+func ViewLineage(db *sql.DB, id int) (*Lineage, error) {
+	const (
+		a = `with recursive up(pk, parent, depth) as
+			(select pk, parent, 0 from schedule.files where pk=$1 union all select fs.pk, fs.parent, up.depth+1 from schedule.files fs join up on fs.pk=up.parent)
+		select v.pk, v.name, v.crc, v.slot, v.location, v.summary, v.categories, v.meta, v.version, v.length, v.sum, v.superseeded, v.original, v.person, v.lastmod, v.checksums from vfiles v join up on v.pk=up.pk where up.depth>0 order by up.depth desc`
+		d = `with recursive down(pk, parent) as
+			(select pk, parent from schedule.files where parent=$1 union all select fs.pk, fs.parent from schedule.files fs join down on fs.parent=down.pk)
+		select v.pk, v.name, v.crc, v.slot, v.location, v.summary, v.categories, v.meta, v.version, v.length, v.sum, v.superseeded, v.original, v.person, v.lastmod, v.checksums, down.parent from vfiles v join down on v.pk=down.pk order by v.pk`
+	)
+	f, err := ViewFile(db, id, false, false)
+	if err != nil {
+		return nil, err
+	}
+	f.Versions = nil
+	g := Lineage{File: f}
+
+	rs, err := db.Query(a, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	for rs.Next() {
+		f, err := scanFiles(rs)
+		if err != nil {
+			return nil, err
+		}
+		g.Ancestors = append(g.Ancestors, f)
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+
+	rs, err = db.Query(d, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	nodes := map[int]*Node{id: &Node{File: f}}
+	var ns []*Node
+	ps := make(map[int]int)
+	for rs.Next() {
+		var p int
+		f, err := scanFiles(rs, &p)
+		if err != nil {
+			return nil, err
+		}
+		n := &Node{File: f}
+		nodes[f.Id], ps[f.Id] = n, p
+		ns = append(ns, n)
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	for _, n := range ns {
+		if p, ok := nodes[ps[n.Id]]; ok {
+			p.Children = append(p.Children, n)
+		}
+	}
+	g.Children = nodes[id].Children
+	return &g, nil
+}
+
+func NewFile(db *sql.DB, f *File) (err error) {
+	defer translate(&err)
+	if err := validateFile(f); err != nil {
+		return err
+	}
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -145,7 +356,8 @@ func NewFile(db *sql.DB, f *File) error {
 	return tx.Commit()
 }
 
-func UpdateFile(db *sql.DB, f *File) error {
+func UpdateFile(db *sql.DB, f *File) (err error) {
+	defer translate(&err)
 	const q = `with
 		u(pk) as (select pk from vusers where initial=$3)
 		update schedule.files set
@@ -174,77 +386,84 @@ func UpdateFile(db *sql.DB, f *File) error {
 	return tx.Commit()
 }
 
-func DeleteFile(db *sql.DB, f *File) error {
+func DeleteFile(db *sql.DB, f *File) (err error) {
+	defer translate(&err)
 	const q = `with u(pk) as (select pk from vusers where initial=$1) update schedule.files set canceled=true, person=(select pk from u), lastmod=current_timestamp where pk=$2 and not canceled`
-	_, err := db.Exec(q, f.User, f.Id)
+	_, err = db.Exec(q, f.User, f.Id)
 	return err
 }
 
 func createFile(tx *sql.Tx, f *File) error {
-	const q = `with
-		u(pk) as (select pk from vusers where initial=$4 limit 1)
-		insert into schedule.files(name, summary, content, person, meta, parent, crc)
-			values($1, $2, $3, (select pk from u), $5, nullif($6, 0), $7) returning pk`
-	m, err := json.Marshal(f.Meta)
+	f.measure()
+	content, err := Store.Put(f.digest, f.Reader())
 	if err != nil {
 		return err
 	}
-	crc, err := calculateCRC(bytes.NewReader(f.Content))
+	return insertFile(tx, f, content)
+}
+
+// insertFile registers f with the content given by the storage (nil when the
+// storage keeps it by itself).
+func insertFile(tx *sql.Tx, f *File, content []byte) error {
+	const q = `with
+		u(pk) as (select pk from vusers where initial=$4 limit 1)
+		insert into schedule.files(name, summary, content, person, meta, parent, crc, length, sum, digest)
+			values($1, $2, $3, (select pk from u), $5, nullif($6, 0), $7, $8, $9, nullif($10, '')) returning pk`
+	m, err := json.Marshal(f.Meta)
 	if err != nil {
 		return err
 	}
-	if err := tx.QueryRow(q, f.Name, f.Summary, f.Content, f.User, m, f.Id, crc).Scan(&f.Id); err != nil {
+	if err := tx.QueryRow(q, f.Name, f.Summary, content, f.User, m, f.Id, f.Cyclic, f.Length, f.Sum, f.digest).Scan(&f.Id); err != nil {
 		return err
 	}
-	f.Dummy = len(f.Content) == 0
+	f.Dummy = f.Length == 0
 	f.Version += 1
 
+	return linkFile2Checksums(tx, f)
+}
+
+func linkFile2Checksums(tx *sql.Tx, f *File) error {
+	const q = `insert into schedule.files_checksums(file, algorithm, value) values($1, $2, $3)`
+	for a, v := range f.Checksums {
+		if _, err := tx.Exec(q, f.Id, a, v); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func linkFile2Categories(tx *sql.Tx, f *File) error {
-	const q = `with c(pk) as (select pk from schedule.categories where name=$2) insert into schedule.files_categories(file, category) values($1, (select pk from c))`
+	const q = `insert into schedule.files_categories(file, category) values($1, $2) on conflict do nothing`
 	for _, c := range f.Categories {
-		if _, err := tx.Exec(q, f.Id, c); err != nil {
+		cid, err := lookupCategory(tx, c)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(q, f.Id, cid); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func scanFiles(s Scanner) (*File, error) {
+func scanFiles(s Scanner, vs ...interface{}) (*File, error) {
 	var (
-		cs   pq.StringArray
-		meta []byte
+		cs         pq.StringArray
+		meta, sums []byte
 	)
 	f := new(File)
-	if err := s.Scan(&f.Id, &f.Name, &f.Cyclic, &f.Slot, &f.Location, &f.Summary, &cs, &meta, &f.Version, &f.Length, &f.Sum, &f.Superseeded, &f.Original, &f.User, &f.Lastmod); err != nil {
+	fs := []interface{}{&f.Id, &f.Name, &f.Cyclic, &f.Slot, &f.Location, &f.Summary, &cs, &meta, &f.Version, &f.Length, &f.Sum, &f.Superseeded, &f.Original, &f.User, &f.Lastmod, &sums}
+	if err := s.Scan(append(fs, vs...)...); err != nil {
 		return nil, err
 	}
 	if err := json.Unmarshal(meta, &f.Meta); meta != nil && err != nil {
 		return nil, err
 	}
+	if err := json.Unmarshal(sums, &f.Checksums); sums != nil && err != nil {
+		return nil, err
+	}
 	f.Dummy = f.Length == 0
 	f.Categories = []string(cs)
 
 	return f, nil
 }
-
-func calculateCRC(r io.Reader) (uint16, error) {
-	rs := bufio.NewReader(r)
-
-	v := uint16(CITT)
-	for {
-		b, err := rs.ReadByte()
-		switch err {
-		case nil:
-			x := (v >> 8) ^ uint16(b)
-			x ^= x >> 4
-			v = (v << 8) ^ (x << 12) ^ (x << 5) ^ x
-		case io.EOF:
-			return v, nil
-		default:
-			return v, err
-		}
-	}
-}
@@ -3,8 +3,11 @@ package hourglass
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"io"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 var (
@@ -12,11 +15,22 @@ var (
 	ErrUnauthenticated = errors.New("invalid credentials")
 	ErrNotSupported    = errors.New("not supported")
 	ErrInvalid         = errors.New("invalid")
+	ErrConflict        = errors.New("conflict")
+	ErrForbidden       = errors.New("forbidden")
+)
+
+const (
+	StateScheduled = "scheduled"
+	StateCompleted = "completed"
+	StateCanceled  = "canceled"
+	StateAborted   = "aborted"
 )
 
 type Error struct {
 	Severity string `json:"severity"`
 	Source   string `json:"source"`
+	Field    string `json:"field,omitempty"`
+	Code     string `json:"code,omitempty"`
 	Message  string `json:"message"`
 }
 
@@ -33,15 +47,26 @@ type Scanner interface {
 }
 
 type Category struct {
-	Id      int       `json:"uid"`
-	Name    string    `json:"name"`
-	User    string    `json:"user"`
-	Lastmod time.Time `json:"lastmod"`
+	Id       int       `json:"uid"`
+	Name     string    `json:"name"`
+	User     string    `json:"user"`
+	Checksum string    `json:"checksum"`
+	Parent   int       `json:"parent"`
+	Archived bool      `json:"archived"`
+	Lastmod  time.Time `json:"lastmod"`
+
+	Categories []*Category `json:"categories,omitempty"`
 }
 
-func ListCategories(db *sql.DB) ([]*Category, error) {
-	const q = `select pk, name, person, lastmod from vcategories`
-	rs, err := db.Query(q)
+// ImplicitCategories allows the creation of the unknown categories given to
+// events, files, todos, journals and incidents.
+var ImplicitCategories bool
+
+// ListCategories gives the categories not archived (or all of them when
+// archived is set).
+func ListCategories(db *sql.DB, archived bool) ([]*Category, error) {
+	const q = `select pk, name, person, lastmod, checksum, parent, archived from vcategories where $1 or not archived`
+	rs, err := db.Query(q, archived)
 	switch err {
 	case nil:
 	case sql.ErrNoRows:
@@ -53,7 +78,7 @@ func ListCategories(db *sql.DB) ([]*Category, error) {
 	data := make([]*Category, 0, 100)
 	for rs.Next() {
 		c := new(Category)
-		if err := rs.Scan(&c.Id, &c.Name, &c.User, &c.Lastmod); err != nil {
+		if err := rs.Scan(&c.Id, &c.Name, &c.User, &c.Lastmod, &c.Checksum, &c.Parent, &c.Archived); err != nil {
 			return nil, err
 		}
 		data = append(data, c)
@@ -62,9 +87,9 @@ func ListCategories(db *sql.DB) ([]*Category, error) {
 }
 
 func ViewCategory(db *sql.DB, id int) (*Category, error) {
-	const q = `select pk, name, person, lastmod from vcategories where pk=$1`
+	const q = `select pk, name, person, lastmod, checksum, parent, archived from vcategories where pk=$1`
 	c := new(Category)
-	err := db.QueryRow(q, id).Scan(&c.Id, &c.Name, &c.User, &c.Lastmod)
+	err := db.QueryRow(q, id).Scan(&c.Id, &c.Name, &c.User, &c.Lastmod, &c.Checksum, &c.Parent, &c.Archived)
 
 	switch err {
 	case nil:
@@ -76,18 +101,226 @@ func ViewCategory(db *sql.DB, id int) (*Category, error) {
 	}
 }
 
-func NewCategory(db *sql.DB, c *Category) error {
-	const q = `with u(pk) as (select pk from vusers where initial=$2) insert into schedule.categories(name, person, parent) values($1, (select pk from u), nullif($3, 0)) returning pk, lastmod`
-	if err := db.QueryRow(q, c.Name, c.User, &c.Id).Scan(&c.Id, &c.Lastmod); err != nil {
+func NewCategory(db *sql.DB, c *Category) (err error) {
+	defer translate(&err)
+	const q = `with u(pk) as (select pk from vusers where initial=$2) insert into schedule.categories(name, person, parent, checksum) values($1, (select pk from u), nullif($3, 0), nullif($4, '')) returning pk, lastmod`
+	if err := checkChecksum(c.Checksum); err != nil {
+		return err
+	}
+	if err := db.QueryRow(q, c.Name, c.User, c.Parent, c.Checksum).Scan(&c.Id, &c.Lastmod); err != nil {
+		return err
+	}
+	return nil
+}
+
+func UpdateCategory(db *sql.DB, c *Category) (err error) {
+	defer translate(&err)
+	const q = `with u(pk) as (select pk from vusers where initial=$2) update schedule.categories set name=$1, person=(select pk from u), checksum=nullif($4, ''), parent=nullif($5, 0), lastmod=current_timestamp where pk=$3 and not canceled returning lastmod`
+	if err := checkChecksum(c.Checksum); err != nil {
+		return err
+	}
+	if err := checkParent(db, c); err != nil {
+		return err
+	}
+	if err := db.QueryRow(q, c.Name, c.User, c.Id, c.Checksum, c.Parent).Scan(&c.Lastmod); err != nil {
 		return err
 	}
 	return nil
 }
 
-func UpdateCategory(db *sql.DB, c *Category) error {
-	const q = `with u(pk) as (select pk from vusers where initial=$2) update schedule.categories set name=$1, person=(select pk from u), lastmod=current_timestamp where pk=$3 and not canceled returning lastmod`
-	if err := db.QueryRow(q, c.Name, c.User, c.Id).Scan(&c.Lastmod); err != nil {
+// ArchiveCategory hides (or shows again) a category from the listings. An
+// archived category stays linked to the existing events, files,...
+func ArchiveCategory(db *sql.DB, id int, archived bool, user string) (err error) {
+	defer translate(&err)
+	const q = `with u(pk) as (select pk from vusers where initial=$3) update schedule.categories set archived=$2, person=(select pk from u), lastmod=current_timestamp where pk=$1 and not canceled`
+	r, err := db.Exec(q, id, archived, user)
+	if err != nil {
+		return err
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// MergeCategories moves every event, file, todo, journal, incident and slot of
+// category from to category to. The sub categories of from are moved under to
+// and from is then canceled. Its name remains an alias of to.
+func MergeCategories(db *sql.DB, from, to int, user string) (err error) {
+	defer translate(&err)
+	if from == to {
+		return Error{
+			Severity: SeverityError,
+			Source:   "categories",
+			Field:    "category",
+			Code:     CodeInvalid,
+			Message:  "category can not be merged into itself",
+		}
+	}
+	links := []struct {
+		Table  string
+		Column string
+	}{
+		{Table: "schedule.events_categories", Column: "event"},
+		{Table: "schedule.files_categories", Column: "file"},
+		{Table: "schedule.todos_categories", Column: "todo"},
+		{Table: "schedule.journals_categories", Column: "journal"},
+		{Table: "schedule.incidents_categories", Column: "incident"},
+	}
+	const (
+		c = `select count(*) from schedule.categories where pk in ($1, $2) and not canceled`
+		s = `update schedule.slots set category=$2 where category=$1`
+		p = `update schedule.categories set parent=$2 where parent=$1 and pk<>$2`
+		m = `update schedule.categories set merged=$2 where merged=$1`
+		u = `with u(pk) as (select pk from vusers where initial=$3) update schedule.categories set canceled=true, merged=$2, parent=null, person=(select pk from u), lastmod=current_timestamp where pk=$1`
+	)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var n int
+	if err := tx.QueryRow(c, from, to).Scan(&n); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n != 2 {
+		tx.Rollback()
+		return ErrNotFound
+	}
+	for _, k := range links {
+		var (
+			i = fmt.Sprintf("insert into %[1]s(%[2]s, category) select %[2]s, $2 from %[1]s where category=$1 on conflict do nothing", k.Table, k.Column)
+			d = fmt.Sprintf("delete from %s where category=$1", k.Table)
+		)
+		if _, err := tx.Exec(i, from, to); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(d, from); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, q := range []string{s, p, m} {
+		if _, err := tx.Exec(q, from, to); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec(u, from, to, user); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// lookupCategory gives the id of the named category, following the merged
+// categories. Unknown categories are created if ImplicitCategories is set.
+func lookupCategory(tx *sql.Tx, name string) (int, error) {
+	const (
+		q = `select coalesce(merged, pk) from schedule.categories where name=$1 and (not canceled or merged is not null)`
+		i = `insert into schedule.categories(name) values($1) returning pk`
+	)
+	var id int
+	err := tx.QueryRow(q, name).Scan(&id)
+	if err == sql.ErrNoRows && ImplicitCategories {
+		err = tx.QueryRow(i, name).Scan(&id)
+	}
+	switch err {
+	case nil:
+		return id, nil
+	case sql.ErrNoRows:
+		return 0, Error{
+			Severity: SeverityError,
+			Source:   "categories",
+			Field:    "categories",
+			Code:     CodeReference,
+			Message:  fmt.Sprintf("category %q does not exist", name),
+		}
+	default:
+		return 0, err
+	}
+}
+
+// CategoryTree gives the root categories with their descendants.
+func CategoryTree(db *sql.DB, archived bool) ([]*Category, error) {
+	cs, err := ListCategories(db, archived)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[int]*Category, len(cs))
+	for _, c := range cs {
+		set[c.Id] = c
+	}
+	var roots []*Category
+	for _, c := range cs {
+		if p, ok := set[c.Parent]; ok {
+			p.Categories = append(p.Categories, c)
+		} else {
+			roots = append(roots, c)
+		}
+	}
+	return roots, nil
+}
+
+// ExpandCategories gives the names of the given categories and of all their
+// descendants.
+func ExpandCategories(db *sql.DB, cs []string) ([]string, error) {
+	if len(cs) == 0 {
+		return cs, nil
+	}
+	const q = `
+		with recursive t(pk, name) as (
+			select pk, name from schedule.categories where name=any($1::varchar[]) and not canceled
+			union
+			select c.pk, c.name from schedule.categories c join t on c.parent=t.pk where not c.canceled
+		)
+		select name from t`
+	rs, err := db.Query(q, pq.StringArray(cs))
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	var vs []string
+	for rs.Next() {
+		var v string
+		if err := rs.Scan(&v); err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	if len(vs) == 0 {
+		return cs, rs.Err()
+	}
+	return vs, rs.Err()
+}
+
+// checkParent refuses a parent that is the category itself or one of its
+// descendants.
+func checkParent(db *sql.DB, c *Category) error {
+	if c.Parent == 0 {
+		return nil
+	}
+	const q = `
+		with recursive t(pk) as (
+			select $1::int
+			union
+			select c.pk from schedule.categories c join t on c.parent=t.pk
+		)
+		select exists(select 1 from t where pk=$2)`
+	var cycle bool
+	if err := db.QueryRow(q, c.Id, c.Parent).Scan(&cycle); err != nil {
 		return err
 	}
+	if cycle {
+		return Error{
+			Severity: SeverityError,
+			Source:   "categories",
+			Field:    "parent",
+			Code:     CodeInvalid,
+			Message:  "category can not be its own ancestor",
+		}
+	}
 	return nil
 }
@@ -0,0 +1,165 @@
+package hourglass
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Batch is a set of events, todos and files imported in a single transaction.
+type Batch struct {
+	Events []*Event `json:"events,omitempty"`
+	Todos  []*Todo  `json:"todos,omitempty"`
+	Files  []*File  `json:"files,omitempty"`
+}
+
+// ImportBatch creates all the items of b or none of them. The items are
+// checked first and all the violations found are reported at once, each one
+// with the position (starting at 1) of its item as source (eg: "events:3").
+// With preview, the transaction is rolled back once every item has been
+// created so that b gives what would be imported; the content of the files is
+// then never written to the storage.
+func ImportBatch(db *sql.DB, b *Batch, user string, preview bool) (err error) {
+	defer translate(&err)
+	if err := checkBatch(b); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for i, e := range b.Events {
+		e.Id, e.User = 0, user
+		if err := importEvent(tx, e); err != nil {
+			tx.Rollback()
+			return batchError("events", i, err)
+		}
+	}
+	for i, t := range b.Todos {
+		t.Id, t.User = 0, user
+		if err := importTodo(tx, t); err != nil {
+			tx.Rollback()
+			return batchError("todos", i, err)
+		}
+	}
+	for i, f := range b.Files {
+		f.Id, f.User = 0, user
+		if err := importFile(tx, f, preview); err != nil {
+			tx.Rollback()
+			return batchError("files", i, err)
+		}
+	}
+	if preview {
+		return tx.Rollback()
+	}
+	return tx.Commit()
+}
+
+func importEvent(tx *sql.Tx, e *Event) error {
+	if err := createEvent(tx, e); err != nil {
+		return err
+	}
+	if err := linkEvent2Categories(tx, e); err != nil {
+		return err
+	}
+	return linkEvent2Attendees(tx, e)
+}
+
+func importTodo(tx *sql.Tx, t *Todo) error {
+	if t.State == "" {
+		t.State = StateScheduled
+	}
+	if t.Priority == "" {
+		t.Priority = "normal"
+	}
+	if err := createTodo(tx, t); err != nil {
+		return err
+	}
+	if err := linkTodo2Categories(tx, t); err != nil {
+		return err
+	}
+	return linkTodo2Assignees(tx, t)
+}
+
+func importFile(tx *sql.Tx, f *File, preview bool) error {
+	var err error
+	if preview {
+		f.measure()
+		err = insertFile(tx, f, nil)
+	} else {
+		err = createFile(tx, f)
+	}
+	if err != nil {
+		return err
+	}
+	return linkFile2Categories(tx, f)
+}
+
+func checkBatch(b *Batch) error {
+	var es Errors
+	for i, e := range b.Events {
+		source := batchSource("events", i)
+		if e.Summary == "" {
+			es = append(es, importError(source, "summary", CodeRequired, "summary is missing"))
+		}
+		if e.Starts.IsZero() || e.Ends.IsZero() {
+			es = append(es, importError(source, "dtstart", CodeRequired, "period is missing"))
+		} else if e.Ends.Before(e.Starts) {
+			es = append(es, importError(source, "dtend", CodeInvalid, "event ends before it starts"))
+		}
+	}
+	for i, t := range b.Todos {
+		source := batchSource("todos", i)
+		if t.Summary == "" {
+			es = append(es, importError(source, "summary", CodeRequired, "summary is missing"))
+		}
+		if t.Due.IsZero() {
+			es = append(es, importError(source, "due", CodeRequired, "due date is missing"))
+		}
+	}
+	for i, f := range b.Files {
+		source := batchSource("files", i)
+		if f.Name == "" {
+			es = append(es, importError(source, "name", CodeRequired, "name is missing"))
+			continue
+		}
+		switch err := validateFile(f).(type) {
+		case nil:
+		case Errors:
+			for _, e := range err {
+				e.Source = source
+				es = append(es, e)
+			}
+		default:
+			return err
+		}
+	}
+	if len(es) > 0 {
+		return es
+	}
+	return nil
+}
+
+func batchSource(kind string, i int) string {
+	return fmt.Sprintf("%s:%d", kind, i+1)
+}
+
+// batchError gives the error returned when an item of a batch can not be
+// created with the position of the item as source.
+func batchError(kind string, i int, err error) error {
+	translate(&err)
+	if e, ok := err.(Error); ok {
+		e.Source = batchSource(kind, i)
+		return e
+	}
+	return err
+}
+
+func importError(source, field, code, msg string) Error {
+	return Error{
+		Severity: SeverityError,
+		Source:   source,
+		Field:    field,
+		Code:     code,
+		Message:  msg,
+	}
+}
@@ -0,0 +1,293 @@
+package hourglass
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	SeverityMinor    = "minor"
+	SeverityMajor    = "major"
+	SeverityCritical = "critical"
+)
+
+const (
+	IncidentOpen          = "open"
+	IncidentInvestigating = "investigating"
+	IncidentResolved      = "resolved"
+	IncidentClosed        = "closed"
+)
+
+// Incident is an anomaly detected during operations. Its timeline is made of
+// the journals written while it was investigated.
+type Incident struct {
+	Id          int                    `json:"uid"`
+	Summary     string                 `json:"summary"`
+	Description string                 `json:"description"`
+	Severity    string                 `json:"severity"`
+	State       string                 `json:"status"`
+	Detected    time.Time              `json:"detected"`
+	Meta        map[string]interface{} `json:"metadata"`
+	User        string                 `json:"user"`
+	Lastmod     time.Time              `json:"lastmod"`
+	Version     int                    `json:"version"`
+	Categories  []string               `json:"categories"`
+	Slots       []int                  `json:"slots"`
+	// Event is the event during which the incident was detected. When not
+	// given, it is the event whose actual times (rtstart/rtend) cover the
+	// detection time.
+	Event    int        `json:"event"`
+	Journals []int      `json:"journals"`
+	Timeline []*Journal `json:"timeline,omitempty"`
+
+	Versions []*Incident `json:"history,omitempty"`
+}
+
+func ListIncidents(db *sql.DB, f, t time.Time, cs, ss, vs []string) ([]*Incident, error) {
+	if f.IsZero() && t.IsZero() {
+		t = time.Now()
+		f = t.AddDate(0, 0, -30)
+	}
+	const q = `select
+			pk, summary, description, severity, state, detected, event, meta, person, lastmod, version, categories, slots, journals
+		from vincidents
+		where
+			detected between $1 and $2
+			and case when cardinality($3::varchar[])>0 then categories&&$3::varchar[] else true end
+			and case when cardinality($4::varchar[])>0 then state=any($4::varchar[]) else true end
+			and case when cardinality($5::varchar[])>0 then severity=any($5::varchar[]) else true end
+		order by detected desc`
+	rs, err := db.Query(q, f.UTC(), t.UTC(), pq.StringArray(cs), pq.StringArray(ss), pq.StringArray(vs))
+	if err != nil {
+		return nil, err
+	}
+	return listIncidents(rs)
+}
+
+func ViewIncident(db *sql.DB, id int) (*Incident, error) {
+	const (
+		q = `select pk, summary, description, severity, state, detected, event, meta, person, lastmod, version, categories, slots, journals from vincidents where pk=$1`
+		v = `select pk, summary, description, severity, state, detected, event, meta, person, lastmod, version, categories, slots, journals from revisions.vincidents where pk=$1`
+	)
+	i, err := scanIncidents(db.QueryRow(q, id))
+	switch err {
+	default:
+		return nil, err
+	case sql.ErrNoRows:
+		return nil, ErrNotFound
+	case nil:
+	}
+	for _, j := range i.Journals {
+		x, err := ViewJournal(db, j)
+		switch err {
+		case nil:
+			x.Versions = nil
+			i.Timeline = append(i.Timeline, x)
+		case ErrNotFound:
+		default:
+			return nil, err
+		}
+	}
+	rs, err := db.Query(v, id)
+	if err != nil {
+		return nil, err
+	}
+	if i.Versions, err = listIncidents(rs); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+func NewIncident(db *sql.DB, i *Incident) (err error) {
+	defer translate(&err)
+	const q = `
+		with
+			u(pk) as (select pk from vusers where initial=$8)
+		insert into schedule.incidents(summary, description, severity, state, detected, event, meta, person)
+			values($1, nullif($2, ''), $3, $4, $5, nullif($6, 0), $7, (select pk from u)) returning pk, lastmod`
+	if i.Detected.IsZero() {
+		i.Detected = time.Now()
+	}
+	if i.Severity == "" {
+		i.Severity = SeverityMinor
+	}
+	if i.State == "" {
+		i.State = IncidentOpen
+	}
+	m, err := json.Marshal(i.Meta)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if i.Event == 0 {
+		if i.Event, err = findIncidentEvent(tx, i.Detected); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.QueryRow(q, i.Summary, i.Description, i.Severity, i.State, i.Detected.UTC(), i.Event, m, i.User).Scan(&i.Id, &i.Lastmod); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := linkIncident(tx, i); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := linkIncident2Journals(tx, i); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func UpdateIncident(db *sql.DB, i *Incident) (err error) {
+	defer translate(&err)
+	const q = `
+		with
+			u(pk) as (select pk from vusers where initial=$8)
+		update schedule.incidents set
+			summary=$1,
+			description=nullif($2, ''),
+			severity=$3,
+			state=$4,
+			detected=$5,
+			event=nullif($6, 0),
+			meta=$7,
+			person=(select pk from u),
+			lastmod=current_timestamp
+		where pk=$9 and not canceled returning lastmod`
+	m, err := json.Marshal(i.Meta)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if i.Event == 0 {
+		if i.Event, err = findIncidentEvent(tx, i.Detected); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.QueryRow(q, i.Summary, i.Description, i.Severity, i.State, i.Detected.UTC(), i.Event, m, i.User, i.Id).Scan(&i.Lastmod); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := linkIncident(tx, i); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`delete from schedule.incidents_journals where incident=$1`, i.Id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := linkIncident2Journals(tx, i); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func DeleteIncident(db *sql.DB, i *Incident) (err error) {
+	defer translate(&err)
+	const q = `with u(pk) as (select pk from vusers where initial=$2) update schedule.incidents set canceled=true, person=(select pk from u), lastmod=current_timestamp where pk=$1 and not canceled`
+	_, err = db.Exec(q, i.Id, i.User)
+	return err
+}
+
+// findIncidentEvent gives the most recent event whose actual times cover the
+// detection time of an incident (or 0 if there are none).
+func findIncidentEvent(tx *sql.Tx, t time.Time) (int, error) {
+	const q = `
+		select pk from schedule.events
+		where
+			not canceled
+			and coalesce(rtstart, dtstart)<=$1
+			and coalesce(rtend, dtend)>=$1
+		order by coalesce(rtstart, dtstart) desc
+		limit 1`
+	var id int
+	switch err := tx.QueryRow(q, t.UTC()).Scan(&id); err {
+	case nil, sql.ErrNoRows:
+		return id, nil
+	default:
+		return 0, err
+	}
+}
+
+func linkIncident(tx *sql.Tx, i *Incident) error {
+	const (
+		c = `insert into schedule.incidents_categories(incident, category) values($1, $2) on conflict do nothing`
+		s = `insert into schedule.incidents_slots(incident, slot) values($1, $2) on conflict do nothing`
+	)
+	for _, n := range i.Categories {
+		cid, err := lookupCategory(tx, n)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(c, i.Id, cid); err != nil {
+			return err
+		}
+	}
+	for _, v := range i.Slots {
+		if _, err := tx.Exec(s, i.Id, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func linkIncident2Journals(tx *sql.Tx, i *Incident) error {
+	const q = `insert into schedule.incidents_journals(incident, journal) values($1, $2) on conflict do nothing`
+	for _, j := range i.Journals {
+		if _, err := tx.Exec(q, i.Id, j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listIncidents(rs *sql.Rows) ([]*Incident, error) {
+	defer rs.Close()
+
+	var is []*Incident
+	for rs.Next() {
+		i, err := scanIncidents(rs)
+		if err != nil {
+			return nil, err
+		}
+		is = append(is, i)
+	}
+	return is, rs.Err()
+}
+
+func scanIncidents(s Scanner) (*Incident, error) {
+	var (
+		i      Incident
+		cs     pq.StringArray
+		ss, js pq.Int64Array
+		m      []byte
+	)
+	if err := s.Scan(&i.Id, &i.Summary, &i.Description, &i.Severity, &i.State, &i.Detected, &i.Event, &m, &i.User, &i.Lastmod, &i.Version, &cs, &ss, &js); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(m, &i.Meta); err != nil && len(m) > 0 {
+		return nil, err
+	}
+	i.Detected = i.Detected.UTC()
+	i.Categories = []string(cs)
+	for _, v := range ss {
+		i.Slots = append(i.Slots, int(v))
+	}
+	for _, v := range js {
+		i.Journals = append(i.Journals, int(v))
+	}
+	return &i, nil
+}
@@ -0,0 +1,186 @@
+package hourglass
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	DriftMissing    = "missing"
+	DriftUnexpected = "unexpected"
+	DriftName       = "name"
+	DriftCRC        = "crc"
+	DriftChecksum   = "checksum"
+	DriftUnknown    = "unknown"
+)
+
+// Onboard describes the file expected on board in a slot at a given instant
+// and the uplink that put it there. Checksum is the value of the file for the
+// algorithm expected by the target of the slot category (CRC16 if the
+// category does not name one).
+type Onboard struct {
+	Slot      int       `json:"slot"`
+	Name      string    `json:"name"`
+	Category  string    `json:"category"`
+	Uplink    int       `json:"uplink"`
+	File      int       `json:"file"`
+	Filename  string    `json:"filename"`
+	Cyclic    uint16    `json:"crc"`
+	Algorithm string    `json:"algorithm"`
+	Checksum  string    `json:"checksum"`
+	Sum       string    `json:"sum"`
+	State     string    `json:"status"`
+	Dtstamp   time.Time `json:"dtstamp"`
+}
+
+// Dump is one line of an onboard dump: the slot, the name and the checksum of
+// the file reported by the target. Checksum is hex encoded and computed with
+// the algorithm of the slot category; targets using CRC16 can give Cyclic
+// instead.
+type Dump struct {
+	Slot     int    `json:"slot"`
+	Name     string `json:"name"`
+	Cyclic   uint16 `json:"crc"`
+	Checksum string `json:"checksum"`
+}
+
+type Drift struct {
+	Slot     int      `json:"slot"`
+	Reason   string   `json:"reason"`
+	Expected *Onboard `json:"expected,omitempty"`
+	Actual   *Dump    `json:"actual,omitempty"`
+}
+
+// Inventory gives per slot the file the ground expects to be on board at the
+// given instant. Before now, only completed uplinks are considered. After now,
+// uplinks still scheduled are considered as executed at their planned time.
+func Inventory(db *sql.DB, at time.Time) ([]*Onboard, error) {
+	const q = `
+		with
+			us(slot, pk, file, state, dtstamp) as (
+				select
+					distinct on (u.slot) u.slot, u.pk, u.file, u.state, coalesce(e.rtstart, e.dtstart)
+				from schedule.uplinks u
+					join schedule.events e on u.event=e.pk
+					join schedule.files f on u.file=f.pk
+				where
+					not e.canceled
+					and f.length>0
+					and coalesce(e.rtstart, e.dtstart)<=$1
+					and (u.state='completed' or (coalesce(e.rtstart, e.dtstart)>current_timestamp and u.state not in ('canceled', 'aborted')))
+				order by u.slot, coalesce(e.rtstart, e.dtstart) desc, u.pk desc
+			)
+		select
+			s.pk,
+			s.name,
+			c.name,
+			coalesce(u.pk, 0),
+			coalesce(f.pk, 0),
+			coalesce(f.name, ''),
+			coalesce(f.crc, 0),
+			coalesce(nullif(c.checksum, ''), $2),
+			coalesce((select k.value from schedule.files_checksums k where k.file=f.pk and k.algorithm=coalesce(nullif(c.checksum, ''), $2)), ''),
+			coalesce(f.sum, ''),
+			coalesce(u.state, 'n/a'),
+			u.dtstamp
+		from schedule.slots s
+			join schedule.categories c on s.category=c.pk
+			left outer join us u on s.pk=u.slot
+			left outer join schedule.files f on u.file=f.pk
+		where
+			not s.canceled
+		order by s.pk`
+	if at.IsZero() {
+		at = time.Now()
+	}
+	rs, err := db.Query(q, at.UTC(), CRC16)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	data := make([]*Onboard, 0, 100)
+	for rs.Next() {
+		var (
+			o  Onboard
+			dt pq.NullTime
+		)
+		if err := rs.Scan(&o.Slot, &o.Name, &o.Category, &o.Uplink, &o.File, &o.Filename, &o.Cyclic, &o.Algorithm, &o.Checksum, &o.Sum, &o.State, &dt); err != nil {
+			return nil, err
+		}
+		if dt.Valid {
+			o.Dtstamp = dt.Time.UTC()
+		}
+		data = append(data, &o)
+	}
+	return data, rs.Err()
+}
+
+// CompareInventory reports the differences between the inventory at the
+// given instant and an onboard dump.
+func CompareInventory(db *sql.DB, at time.Time, ds []*Dump) ([]*Drift, error) {
+	is, err := Inventory(db, at)
+	if err != nil {
+		return nil, err
+	}
+	return compareInventory(is, ds), nil
+}
+
+func compareInventory(is []*Onboard, ds []*Dump) []*Drift {
+	actual := make(map[int]*Dump)
+	for _, d := range ds {
+		actual[d.Slot] = d
+	}
+	var data []*Drift
+	for _, o := range is {
+		d, ok := actual[o.Slot]
+		delete(actual, o.Slot)
+		if ok && d.Name == "" {
+			d, ok = nil, false
+		}
+
+		f := Drift{Slot: o.Slot, Expected: o, Actual: d}
+		switch {
+		case o.File == 0 && !ok:
+			continue
+		case o.File == 0:
+			f.Reason, f.Expected = DriftUnexpected, nil
+		case !ok:
+			f.Reason = DriftMissing
+		case d.Name != o.Filename:
+			f.Reason = DriftName
+		case !sameChecksum(o, d):
+			f.Reason = DriftChecksum
+			if o.Algorithm == CRC16 {
+				f.Reason = DriftCRC
+			}
+		default:
+			continue
+		}
+		data = append(data, &f)
+	}
+	for _, d := range actual {
+		data = append(data, &Drift{Slot: d.Slot, Reason: DriftUnknown, Actual: d})
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].Slot < data[j].Slot })
+	return data
+}
+
+// sameChecksum compares the checksum of the expected file with the one given
+// by the dump using the algorithm of the slot category. When the dump does not
+// give a checksum, only the CRC16 can be compared.
+func sameChecksum(o *Onboard, d *Dump) bool {
+	if d.Checksum == "" {
+		return d.Cyclic == o.Cyclic
+	}
+	sum := o.Checksum
+	if sum == "" && o.Algorithm == CRC16 {
+		sum = fmt.Sprintf("%04x", o.Cyclic)
+	}
+	return strings.EqualFold(strings.TrimPrefix(d.Checksum, "0x"), sum)
+}
@@ -3,11 +3,31 @@ package hourglass
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/lib/pq"
 )
 
+const (
+	SignoffDraft     = "draft"
+	SignoffSubmitted = "submitted"
+	SignoffApproved  = "approved"
+	SignoffLocked    = "locked"
+)
+
+// ApproverPosition is the abbreviation of the position whose holders can
+// approve a journal. Journals can not be approved when empty.
+var ApproverPosition string
+
+// signoffs gives the sign-off states reachable from each state. A submitted
+// journal can be sent back to draft if it is not approved.
+var signoffs = map[string][]string{
+	SignoffDraft:     {SignoffSubmitted},
+	SignoffSubmitted: {SignoffDraft, SignoffApproved},
+	SignoffApproved:  {SignoffLocked},
+}
+
 type Journal struct {
 	Id         int                    `json:"uid"`
 	Day        time.Time              `json:"dtstamp"`
@@ -17,17 +37,39 @@ type Journal struct {
 	Lastmod    time.Time              `json:"lastmod"`
 	Meta       map[string]interface{} `json:"metadata"`
 	Categories []string               `json:"categories"`
+	Signoff    string                 `json:"signoff"`
+	Approver   string                 `json:"approver,omitempty"`
+	Approved   time.Time              `json:"approved,omitempty"`
+
+	Attachments []*File `json:"attachments,omitempty"`
+	Links       []*Link `json:"links,omitempty"`
 
-	Versions []*Journal `json:"history,omitempty"`
+	Addenda  []*Addendum `json:"addenda,omitempty"`
+	Versions []*Journal  `json:"history,omitempty"`
 }
 
-func ListJournals(db *sql.DB, f, t time.Time, cs []string) ([]*Journal, error) {
+// Addendum is a note appended to a journal. It is the only way to complete a
+// journal once locked.
+type Addendum struct {
+	Id      int       `json:"uid"`
+	Body    string    `json:"body"`
+	User    string    `json:"user"`
+	Lastmod time.Time `json:"lastmod"`
+}
+
+func ListJournals(db *sql.DB, f, t time.Time, cs, ss []string) ([]*Journal, error) {
 	if f.IsZero() && t.IsZero() {
 		f = time.Now().Truncate(time.Hour * 24)
 		t = f.Add(time.Hour * 24)
 	}
-	const q = `select pk, day, summary, meta, state, lastmod, person, categories from vjournals where day between $1 and $2 and case when cardinality($3::varchar[])>0 then categories&&$3::varchar[] else true end`
-	rs, err := db.Query(q, f, t, pq.StringArray(cs))
+	const q = `select
+			pk, day, summary, meta, state, lastmod, person, categories, signoff, approver, approved
+		from vjournals
+		where
+			day between $1 and $2
+			and case when cardinality($3::varchar[])>0 then categories&&$3::varchar[] else true end
+			and case when cardinality($4::varchar[])>0 then signoff=any($4::varchar[]) else true end`
+	rs, err := db.Query(q, f, t, pq.StringArray(cs), pq.StringArray(ss))
 	switch err {
 	case nil:
 	case sql.ErrNoRows:
@@ -40,8 +82,8 @@ func ListJournals(db *sql.DB, f, t time.Time, cs []string) ([]*Journal, error) {
 
 func ViewJournal(db *sql.DB, id int) (*Journal, error) {
 	const (
-		q = `select pk, day, summary, meta, state, lastmod, person, categories from vjournals where pk=$1`
-		v = `select pk, day, summary, meta, state, lastmod, person, categories from revisions.vjournals where pk=$1`
+		q = `select pk, day, summary, meta, state, lastmod, person, categories, signoff, approver, approved from vjournals where pk=$1`
+		v = `select pk, day, summary, meta, state, lastmod, person, categories, signoff, approver, approved from revisions.vjournals where pk=$1`
 	)
 	j, err := scanJournals(db.QueryRow(q, id))
 	switch err {
@@ -61,10 +103,22 @@ func ViewJournal(db *sql.DB, id int) (*Journal, error) {
 	default:
 		return nil, err
 	}
+	if err != nil {
+		return nil, err
+	}
+	if j.Attachments, err = listAttachments(db, id); err != nil {
+		return nil, err
+	}
+	const r = `select kind, ref from schedule.journals_links where journal=$1 order by kind, ref`
+	if j.Links, err = queryLinks(db, r, id, true); err != nil {
+		return nil, err
+	}
+	j.Addenda, err = listAddenda(db, id)
 	return j, err
 }
 
-func NewJournal(db *sql.DB, j *Journal) error {
+func NewJournal(db *sql.DB, j *Journal) (err error) {
+	defer translate(&err)
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -77,10 +131,19 @@ func NewJournal(db *sql.DB, j *Journal) error {
 		tx.Rollback()
 		return err
 	}
+	if err := linkJournal2Files(tx, j); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := linkJournal2Links(tx, j); err != nil {
+		tx.Rollback()
+		return err
+	}
 	return tx.Commit()
 }
 
-func UpdateJournal(db *sql.DB, j *Journal) error {
+func UpdateJournal(db *sql.DB, j *Journal) (err error) {
+	defer translate(&err)
 	const q = `with u(pk) as (select pk from vusers where initial=$6)
 	update schedule.journals set day=$1, summary=$2, meta=$3, state=$4, person=(select pk from u), lastmod=current_timestamp where pk=$5 and not canceled returning lastmod`
 	m, err := json.Marshal(j.Meta)
@@ -91,6 +154,10 @@ func UpdateJournal(db *sql.DB, j *Journal) error {
 	if err != nil {
 		return err
 	}
+	if err := checkDraft(tx, j.Id); err != nil {
+		tx.Rollback()
+		return err
+	}
 	if err := tx.QueryRow(q, j.Day, j.Summary, m, j.State, j.Id, j.User).Scan(&j.Lastmod); err != nil {
 		tx.Rollback()
 		return err
@@ -99,13 +166,206 @@ func UpdateJournal(db *sql.DB, j *Journal) error {
 		tx.Rollback()
 		return err
 	}
+	if err := unlinkJournal(tx, j.Id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := linkJournal2Files(tx, j); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := linkJournal2Links(tx, j); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// AttachFile creates a new file and attaches it to a draft journal.
+func AttachFile(db *sql.DB, id int, f *File) (err error) {
+	defer translate(&err)
+	const q = `insert into schedule.journals_files(journal, file) values($1, $2)`
+	if err := validateFile(f); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := checkDraft(tx, id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := createFile(tx, f); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := linkFile2Categories(tx, f); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(q, id, f.Id); err != nil {
+		tx.Rollback()
+		return err
+	}
 	return tx.Commit()
 }
 
-func DeleteJournal(db *sql.DB, j *Journal) error {
+func DeleteJournal(db *sql.DB, j *Journal) (err error) {
+	defer translate(&err)
 	const q = `with u(pk) as (select pk from vusers where initial=$2) update schedule.journals set canceled=true, lastmod=current_timestamp, person=(select pk from u) where pk=$1`
-	_, err := db.Exec(q, j.Id, j.User)
-	return err
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := checkDraft(tx, j.Id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(q, j.Id, j.User); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SignoffJournal moves a journal to the given sign-off state. Approving a
+// journal records the approver and the time of the approval. The categories
+// of the journal are linked again since the revision trigger drops them.
+func SignoffJournal(db *sql.DB, id int, state, user string) (err error) {
+	defer translate(&err)
+	const (
+		q = `select signoff from schedule.journals where pk=$1 and not canceled for update`
+		c = `select categories from vjournals where pk=$1`
+		a = `select exists(select 1 from vusers where initial=$1 and $2=any(positions))`
+		u = `with u(pk) as (select pk from vusers where initial=$3)
+		update schedule.journals set
+			signoff=$2,
+			person=coalesce((select pk from u), person),
+			lastmod=current_timestamp,
+			approver=case when $2='approved' then (select pk from u) when $2='draft' then null else approver end,
+			approved=case when $2='approved' then current_timestamp when $2='draft' then null else approved end
+		where pk=$1`
+	)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var current string
+	if err := tx.QueryRow(q, id).Scan(&current); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if !canSignoff(current, state) {
+		tx.Rollback()
+		return Error{
+			Severity: SeverityError,
+			Source:   "journals",
+			Field:    "signoff",
+			Code:     CodeConflict,
+			Message:  fmt.Sprintf("journal can not move from %s to %s", current, state),
+		}
+	}
+	if state == SignoffApproved {
+		if ApproverPosition == "" {
+			tx.Rollback()
+			return Error{
+				Severity: SeverityError,
+				Source:   "journals",
+				Field:    "approver",
+				Code:     CodeForbidden,
+				Message:  "no approver position configured",
+			}
+		}
+		var ok bool
+		if err := tx.QueryRow(a, user, ApproverPosition).Scan(&ok); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if !ok {
+			tx.Rollback()
+			return Error{
+				Severity: SeverityError,
+				Source:   "journals",
+				Field:    "approver",
+				Code:     CodeForbidden,
+				Message:  fmt.Sprintf("only %s can approve a journal", ApproverPosition),
+			}
+		}
+	}
+	var (
+		cs pq.StringArray
+		j  = Journal{Id: id}
+	)
+	if err := tx.QueryRow(c, id).Scan(&cs); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(u, id, state, user); err != nil {
+		tx.Rollback()
+		return err
+	}
+	j.Categories = []string(cs)
+	if err := linkJournal2Categories(tx, &j); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddAddendum appends a note to a journal whatever its sign-off state.
+func AddAddendum(db *sql.DB, id int, a *Addendum) (err error) {
+	defer translate(&err)
+	const q = `with u(pk) as (select pk from vusers where initial=$3) insert into schedule.journals_addenda(journal, body, person) values($1, $2, (select pk from u)) returning pk, lastmod`
+	return db.QueryRow(q, id, a.Body, a.User).Scan(&a.Id, &a.Lastmod)
+}
+
+func listAddenda(db *sql.DB, id int) ([]*Addendum, error) {
+	const q = `select a.pk, a.body, p.initial, a.lastmod from schedule.journals_addenda a join usoc.persons p on a.person=p.pk where a.journal=$1 order by a.lastmod`
+	rs, err := db.Query(q, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	var as []*Addendum
+	for rs.Next() {
+		a := new(Addendum)
+		if err := rs.Scan(&a.Id, &a.Body, &a.User, &a.Lastmod); err != nil {
+			return nil, err
+		}
+		as = append(as, a)
+	}
+	return as, rs.Err()
+}
+
+func canSignoff(from, to string) bool {
+	for _, s := range signoffs[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDraft refuses the modification of a journal once it has been
+// submitted.
+func checkDraft(tx *sql.Tx, id int) error {
+	const q = `select signoff from schedule.journals where pk=$1 and not canceled for update`
+	var s string
+	if err := tx.QueryRow(q, id).Scan(&s); err != nil {
+		return err
+	}
+	if s != SignoffDraft {
+		return Error{
+			Severity: SeverityError,
+			Source:   "journals",
+			Field:    "signoff",
+			Code:     CodeForbidden,
+			Message:  fmt.Sprintf("journal is %s and can not be modified", s),
+		}
+	}
+	return nil
 }
 
 func listJournals(rs *sql.Rows) ([]*Journal, error) {
@@ -127,10 +387,14 @@ func scanJournals(s Scanner) (*Journal, error) {
 		j  Journal
 		cs pq.StringArray
 		m  []byte
+		a  pq.NullTime
 	)
-	if err := s.Scan(&j.Id, &j.Day, &j.Summary, &m, &j.State, &j.Lastmod, &j.User, &cs); err != nil {
+	if err := s.Scan(&j.Id, &j.Day, &j.Summary, &m, &j.State, &j.Lastmod, &j.User, &cs, &j.Signoff, &j.Approver, &a); err != nil {
 		return nil, err
 	}
+	if a.Valid {
+		j.Approved = a.Time
+	}
 	if err := json.Unmarshal(m, &j.Meta); err != nil && m != nil {
 		return nil, err
 	}
@@ -152,14 +416,79 @@ func createJournal(tx *sql.Tx, j *Journal) error {
 	return r.Scan(&j.Id, &j.Lastmod)
 }
 
+// unlinkJournal removes the attachments and the references of a journal
+// before they are linked again on update.
+func unlinkJournal(tx *sql.Tx, id int) error {
+	if _, err := tx.Exec(`delete from schedule.journals_files where journal=$1`, id); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`delete from schedule.journals_links where journal=$1`, id)
+	return err
+}
+
+func linkJournal2Files(tx *sql.Tx, j *Journal) error {
+	const q = `insert into schedule.journals_files(journal, file) values($1, $2) on conflict do nothing`
+	for _, f := range j.Attachments {
+		if _, err := tx.Exec(q, j.Id, f.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func linkJournal2Links(tx *sql.Tx, j *Journal) error {
+	const q = `insert into schedule.journals_links(journal, kind, ref) values($1, $2, $3) on conflict do nothing`
+	for _, l := range j.Links {
+		if err := checkLink(tx, "journals", l, journalLinks); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(q, j.Id, l.Kind, l.Ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listAttachments(db *sql.DB, id int) ([]*File, error) {
+	const q = `select file from schedule.journals_files where journal=$1 order by file`
+	rs, err := db.Query(q, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	var ids []int
+	for rs.Next() {
+		var i int
+		if err := rs.Scan(&i); err != nil {
+			return nil, err
+		}
+		ids = append(ids, i)
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	rs.Close()
+
+	var fs []*File
+	for _, i := range ids {
+		f, err := ViewFile(db, i, false, false)
+		switch err {
+		case nil:
+			fs = append(fs, f)
+		case ErrNotFound:
+		default:
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
 func linkJournal2Categories(tx *sql.Tx, j *Journal) error {
-	const (
-		r = `insert into schedule.categories(name) values($1) on conflict(name) do update set name=$1 returning pk`
-		s = `insert into schedule.journals_categories(journal, category) values($1, $2) on conflict do nothing`
-	)
+	const s = `insert into schedule.journals_categories(journal, category) values($1, $2) on conflict do nothing`
 	for _, c := range j.Categories {
-		var cid int
-		if err := tx.QueryRow(r, c).Scan(&cid); err != nil {
+		cid, err := lookupCategory(tx, c)
+		if err != nil {
 			return err
 		}
 		if _, err := tx.Exec(s, j.Id, cid); err != nil {
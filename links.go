@@ -0,0 +1,208 @@
+package hourglass
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+const (
+	LinkEvent    = "event"
+	LinkFile     = "file"
+	LinkSlot     = "slot"
+	LinkUplink   = "uplink"
+	LinkTransfer = "transfer"
+	LinkTodo     = "todo"
+)
+
+var linkTables = map[string]string{
+	LinkEvent:    "schedule.events",
+	LinkFile:     "schedule.files",
+	LinkSlot:     "schedule.slots",
+	LinkUplink:   "schedule.uplinks",
+	LinkTransfer: "schedule.transfers",
+	LinkTodo:     "schedule.todos",
+}
+
+// kinds of objects that todos and journals can reference.
+var (
+	todoLinks    = []string{LinkEvent, LinkFile, LinkSlot, LinkUplink}
+	journalLinks = []string{LinkEvent, LinkUplink, LinkTransfer, LinkTodo}
+)
+
+// Link is a typed reference from a todo or a journal to another object. Value
+// is the referenced object, only resolved when viewing the todo or the
+// journal: lists give the kind and the ref only.
+type Link struct {
+	Kind  string      `json:"kind"`
+	Ref   int         `json:"ref"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+func AddTodoLinks(db *sql.DB, id int, ls []*Link) (err error) {
+	defer translate(&err)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := linkTodo2Links(tx, id, ls); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func DeleteTodoLink(db *sql.DB, id int, kind string, ref int) error {
+	const q = `delete from schedule.todos_links where todo=$1 and kind=$2 and ref=$3`
+	r, err := db.Exec(q, id, kind, ref)
+	if err != nil {
+		return err
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func linkTodo2Links(tx *sql.Tx, id int, ls []*Link) error {
+	const q = `insert into schedule.todos_links(todo, kind, ref) values($1, $2, $3) on conflict do nothing`
+	for _, l := range ls {
+		if err := checkLink(tx, "todos", l, todoLinks); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(q, id, l.Kind, l.Ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLink verifies that the kind of l is one of the given kinds and that the
+// referenced object exists.
+func checkLink(tx *sql.Tx, source string, l *Link, kinds []string) error {
+	var t string
+	for _, k := range kinds {
+		if k == l.Kind {
+			t = linkTables[k]
+			break
+		}
+	}
+	if t == "" {
+		return linkError(source, "unknown kind %s", l.Kind)
+	}
+	var found bool
+	if err := tx.QueryRow(fmt.Sprintf("select exists(select 1 from %s where pk=$1)", t), l.Ref).Scan(&found); err != nil {
+		return err
+	}
+	if !found {
+		return linkError(source, "%s %d does not exist", l.Kind, l.Ref)
+	}
+	return nil
+}
+
+func listLinks(db *sql.DB, id int, resolve bool) ([]*Link, error) {
+	const q = `select kind, ref from schedule.todos_links where todo=$1 order by kind, ref`
+	return queryLinks(db, q, id, resolve)
+}
+
+// listTodosLinks gives, without resolving them, the links of the todos listed.
+func listTodosLinks(db *sql.DB, ts []*Todo) error {
+	const q = `select todo, kind, ref from schedule.todos_links where todo=any($1) order by todo, kind, ref`
+	if len(ts) == 0 {
+		return nil
+	}
+	var (
+		ids = make(pq.Int64Array, len(ts))
+		ix  = make(map[int64]*Todo, len(ts))
+	)
+	for i, t := range ts {
+		ids[i] = int64(t.Id)
+		ix[ids[i]] = t
+	}
+	rs, err := db.Query(q, ids)
+	if err != nil {
+		return err
+	}
+	defer rs.Close()
+	for rs.Next() {
+		var (
+			id int64
+			l  Link
+		)
+		if err := rs.Scan(&id, &l.Kind, &l.Ref); err != nil {
+			return err
+		}
+		if t, ok := ix[id]; ok {
+			t.Links = append(t.Links, &l)
+		}
+	}
+	return rs.Err()
+}
+
+func queryLinks(db *sql.DB, q string, id int, resolve bool) ([]*Link, error) {
+	rs, err := db.Query(q, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	var ls []*Link
+	for rs.Next() {
+		l := new(Link)
+		if err := rs.Scan(&l.Kind, &l.Ref); err != nil {
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	if err := rs.Err(); err != nil || !resolve {
+		return ls, err
+	}
+	for _, l := range ls {
+		switch l.Kind {
+		case LinkEvent:
+			l.Value, err = ViewEvent(db, l.Ref)
+		case LinkFile:
+			l.Value, err = ViewFile(db, l.Ref, false, false)
+		case LinkSlot:
+			l.Value, err = viewSlot(db, l.Ref)
+		case LinkUplink:
+			l.Value, err = ViewUplink(db, l.Ref)
+		case LinkTransfer:
+			l.Value, err = ViewTransfer(db, l.Ref)
+		case LinkTodo:
+			l.Value, err = ViewTodo(db, l.Ref)
+		}
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+	}
+	return ls, nil
+}
+
+// listLinkedTodos gives the todos still open that reference the given object.
+func listLinkedTodos(db *sql.DB, kind string, ref int) ([]*Todo, error) {
+	const q = `
+		select
+			t.pk, t.summary, t.description, t.state, t.priority, t.person, t.version, t.meta, t.categories, t.assignees, t.dtstart, t.dtend, t.due, t.lastmod, coalesce(t.parent, 0), t.progress
+		from vtodos t
+			join schedule.todos_links l on t.pk=l.todo
+		where
+			l.kind=$1 and l.ref=$2
+			and t.state not in ('completed', 'canceled', 'aborted')`
+	rs, err := db.Query(q, kind, ref)
+	if err != nil {
+		return nil, err
+	}
+	return listTodos(rs)
+}
+
+func linkError(source string, msg string, args ...interface{}) error {
+	return Error{
+		Severity: SeverityError,
+		Source:   source,
+		Field:    "links",
+		Code:     CodeReference,
+		Message:  fmt.Sprintf(msg, args...),
+	}
+}
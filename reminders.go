@@ -0,0 +1,98 @@
+package hourglass
+
+import (
+	"database/sql"
+	"time"
+)
+
+const (
+	ThresholdSoon    = "soon"
+	ThresholdOverdue = "overdue"
+)
+
+// Reminder is a notification to send to an assignee of a todo that is due
+// soon or overdue.
+type Reminder struct {
+	Todo      *Todo  `json:"todo"`
+	Initial   string `json:"initial"`
+	Email     string `json:"email"`
+	Threshold string `json:"threshold"`
+}
+
+// PendingReminders gives the reminders not yet sent for the todos not
+// completed that are overdue or due within the given window. Assignees without
+// email are left out.
+func PendingReminders(db *sql.DB, window time.Duration) ([]*Reminder, error) {
+	const q = `
+		with r(todo, person, threshold) as (
+			select
+				t.pk,
+				p.pk,
+				case when t.due <= current_timestamp then 'overdue' else 'soon' end
+			from schedule.todos t
+				join schedule.assignees a on t.pk=a.todo
+				join usoc.persons p on a.person=p.pk
+			where
+				not t.canceled
+				and t.state not in ('completed', 'canceled', 'aborted')
+				and t.due <= current_timestamp + $1::interval
+				and trim(p.email)<>''
+		)
+		select
+			r.todo,
+			p.initial,
+			p.email,
+			r.threshold
+		from r
+			join usoc.persons p on r.person=p.pk
+			left outer join schedule.reminders x on r.todo=x.todo and r.person=x.person and r.threshold=x.threshold
+		where x.todo is null
+		order by r.todo, p.initial`
+	rs, err := db.Query(q, window.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	var (
+		data []*Reminder
+		ids  []int
+	)
+	for rs.Next() {
+		var (
+			r  Reminder
+			id int
+		)
+		if err := rs.Scan(&id, &r.Initial, &r.Email, &r.Threshold); err != nil {
+			return nil, err
+		}
+		data, ids = append(data, &r), append(ids, id)
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	rs.Close()
+
+	const v = `select pk, summary, description, state, priority, person, version, meta, categories, assignees, dtstart, dtend, due, lastmod, coalesce(parent, 0), progress from vtodos where pk=$1`
+	ts := make(map[int]*Todo)
+	for i, id := range ids {
+		if _, ok := ts[id]; !ok {
+			t, err := scanTodos(db.QueryRow(v, id))
+			if err != nil {
+				return nil, err
+			}
+			ts[id] = t
+		}
+		data[i].Todo = ts[id]
+	}
+	return data, nil
+}
+
+// MarkReminded records that the reminder has been delivered so that it is not
+// sent again.
+func MarkReminded(db *sql.DB, r *Reminder) (err error) {
+	defer translate(&err)
+	const q = `with u(pk) as (select pk from vusers where initial=$2) insert into schedule.reminders(todo, person, threshold) values($1, (select pk from u), $3) on conflict do nothing`
+	_, err = db.Exec(q, r.Todo.Id, r.Initial, r.Threshold)
+	return err
+}
@@ -0,0 +1,410 @@
+package hourglass
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+	"github.com/lib/pq"
+)
+
+// Report is the Daily Operations Report (DOR) of a day.
+type Report struct {
+	Day       time.Time   `json:"day"`
+	Journals  []*Journal  `json:"journals"`
+	Events    []*Event    `json:"events"`
+	Uplinks   []*Uplink   `json:"uplinks"`
+	Downlinks []*Uplink   `json:"downlinks"`
+	Transfers []*Transfer `json:"transfers"`
+	Todos     []*Todo     `json:"todos"`
+}
+
+// BuildReport collects the journals, events, uplinks, downlinks, transfers
+// and closed todos of the given day.
+func BuildReport(db *sql.DB, day time.Time) (*Report, error) {
+	fd := day.UTC().Truncate(time.Hour * 24)
+	td := fd.Add(time.Hour * 24)
+
+	var (
+		r   = Report{Day: fd}
+		ss  = []string{StateCompleted, StateAborted}
+		err error
+	)
+	if r.Journals, err = ListJournals(db, fd, td, nil, nil); err != nil {
+		return nil, err
+	}
+	if r.Events, err = listReportEvents(db, fd, td); err != nil {
+		return nil, err
+	}
+	if r.Uplinks, err = listReportUplinks(db, fd, td, ss); err != nil {
+		return nil, err
+	}
+	if r.Downlinks, err = ListDownlinks(db, fd, td, nil, ss); err != nil {
+		return nil, err
+	}
+	if r.Transfers, err = listReportTransfers(db, fd, td, ss); err != nil {
+		return nil, err
+	}
+	if r.Todos, err = listClosedTodos(db, fd, td); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// listReportEvents gives the events of every source planned in the given
+// period.
+func listReportEvents(db *sql.DB, fd, td time.Time) ([]*Event, error) {
+	const q = `
+		select
+			pk, source, summary, description, meta, state, version, dtstart, dtend, rtstart, rtend, person, attendees, categories, lastmod
+		from vevents
+		where
+			dtstart between $1 and $2 or ($1, $2) overlaps(dtstart, dtend)
+		order by dtstart`
+	rs, err := db.Query(q, fd, td)
+	if err != nil {
+		return nil, err
+	}
+	return listEvents(rs)
+}
+
+// listReportUplinks gives the uplinks in the given states, including the ones
+// replaced since in their slot.
+func listReportUplinks(db *sql.DB, fd, td time.Time, ss []string) ([]*Uplink, error) {
+	const q = `
+		select
+			pk, dropbox, state, person, lastmod, slot, event, file
+		from vuplinkshistory
+		where
+			dtstamp between $1 and $2
+			and state=any($3::usoc.status[])
+		order by dtstamp`
+	rs, err := db.Query(q, fd, td, pq.StringArray(ss))
+	if err != nil {
+		return nil, err
+	}
+	return listUplinks(db, rs)
+}
+
+// listReportTransfers gives the transfers of all categories in the given
+// states.
+func listReportTransfers(db *sql.DB, fd, td time.Time, ss []string) ([]*Transfer, error) {
+	const q = `
+		select
+			pk, state, person, location, lastmod, event, file, slot
+		from vtransfers
+		where
+			dtstamp between $1 and $2
+			and state=any($3::usoc.status[])`
+	rs, err := db.Query(q, fd, td, pq.StringArray(ss))
+	if err != nil {
+		return nil, err
+	}
+	return listTransfers(db, rs)
+}
+
+func listClosedTodos(db *sql.DB, fd, td time.Time) ([]*Todo, error) {
+	const q = `
+		select
+			pk, summary, description, state, priority, person, version, meta, categories, assignees, dtstart, dtend, due, lastmod, coalesce(parent, 0), progress
+		from vtodos
+		where
+			state in ('completed', 'canceled', 'aborted')
+			and lastmod>=$1 and lastmod<$2
+		order by lastmod`
+	rs, err := db.Query(q, fd, td)
+	if err != nil {
+		return nil, err
+	}
+	return listTodos(rs)
+}
+
+// section is the format independent layout of a part of a report: some
+// paragraphs followed by a table.
+type section struct {
+	Title   string
+	Text    []string
+	Headers []string
+	Rows    [][]string
+}
+
+func (r *Report) Title() string {
+	return fmt.Sprintf("Daily Operations Report - %s", r.Day.Format("2006-01-02"))
+}
+
+func (r *Report) sections() []section {
+	var (
+		js = section{Title: "Journals"}
+		es = section{
+			Title:   "Events",
+			Headers: []string{"#", "summary", "status", "planned", "actual", "delay"},
+		}
+		us = section{
+			Title:   "Uplinks",
+			Headers: []string{"#", "dropbox", "slot", "file", "event", "status"},
+		}
+		ds = section{
+			Title:   "Downlinks",
+			Headers: []string{"#", "slot", "file", "event", "status"},
+		}
+		xs = section{
+			Title:   "Transfers",
+			Headers: []string{"#", "location", "slot", "file", "status"},
+		}
+		ts = section{
+			Title:   "Todos",
+			Headers: []string{"#", "summary", "status", "assignees", "closed"},
+		}
+	)
+	for _, j := range r.Journals {
+		js.Text = append(js.Text, fmt.Sprintf("[%s] %s (%s)", j.State, j.Summary, j.User))
+	}
+	for _, e := range r.Events {
+		delay := "-"
+		if !e.ExStarts.IsZero() {
+			delay = e.ExStarts.Sub(e.Starts).String()
+		}
+		row := []string{
+			strconv.Itoa(e.Id),
+			e.Summary,
+			e.State,
+			formatPeriod(e.Starts, e.Ends),
+			formatPeriod(e.ExStarts, e.ExEnds),
+			delay,
+		}
+		es.Rows = append(es.Rows, row)
+	}
+	for _, u := range r.Uplinks {
+		row := []string{strconv.Itoa(u.Id), u.Name, slotName(u.Slot), fileName(u.File), eventName(u.Event), u.Status}
+		us.Rows = append(us.Rows, row)
+	}
+	for _, u := range r.Downlinks {
+		row := []string{strconv.Itoa(u.Id), slotName(u.Slot), fileName(u.File), eventName(u.Event), u.Status}
+		ds.Rows = append(ds.Rows, row)
+	}
+	for _, t := range r.Transfers {
+		row := []string{strconv.Itoa(t.Id), t.Location, slotName(t.Slot), fileName(t.File), t.Status}
+		xs.Rows = append(xs.Rows, row)
+	}
+	for _, t := range r.Todos {
+		row := []string{strconv.Itoa(t.Id), t.Summary, t.State, strings.Join(t.Assignees, ", "), formatTime(t.Lastmod)}
+		ts.Rows = append(ts.Rows, row)
+	}
+	return []section{js, es, us, ds, xs, ts}
+}
+
+// Markdown writes the report as a Markdown document.
+func (r *Report) Markdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n", r.Title())
+	for _, s := range r.sections() {
+		fmt.Fprintf(&b, "\n## %s\n\n", s.Title)
+		if len(s.Text) == 0 && len(s.Rows) == 0 {
+			b.WriteString("_nothing to report_\n")
+			continue
+		}
+		for _, t := range s.Text {
+			fmt.Fprintf(&b, "* %s\n", escapeMarkdown(t))
+		}
+		if len(s.Rows) == 0 {
+			continue
+		}
+		writeMarkdownRow(&b, s.Headers)
+		b.WriteString("|")
+		for range s.Headers {
+			b.WriteString(" --- |")
+		}
+		b.WriteString("\n")
+		for _, row := range s.Rows {
+			writeMarkdownRow(&b, row)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeMarkdownRow(b *strings.Builder, vs []string) {
+	b.WriteString("|")
+	for _, v := range vs {
+		fmt.Fprintf(b, " %s |", escapeMarkdown(v))
+	}
+	b.WriteString("\n")
+}
+
+func escapeMarkdown(s string) string {
+	s = strings.Replace(s, "|", `\|`, -1)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+var reportHTML = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #999; padding: 4px 8px; text-align: left; }
+th { background: #eee; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{range .Sections}}
+<h2>{{.Title}}</h2>
+{{if and (not .Text) (not .Rows)}}<p><em>nothing to report</em></p>{{end}}
+{{with .Text}}<ul>{{range .}}<li>{{.}}</li>{{end}}</ul>{{end}}
+{{if .Rows}}<table>
+<thead><tr>{{range .Headers}}<th>{{.}}</th>{{end}}</tr></thead>
+<tbody>{{range .Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>{{end}}</tbody>
+</table>{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// HTML writes the report as a standalone HTML document.
+func (r *Report) HTML(w io.Writer) error {
+	v := struct {
+		Title    string
+		Sections []section
+	}{
+		Title:    r.Title(),
+		Sections: r.sections(),
+	}
+	return reportHTML.Execute(w, v)
+}
+
+// PDF writes the report as a PDF document.
+func (r *Report) PDF(w io.Writer) error {
+	pdf := gofpdf.New("L", "mm", "A4", "")
+	pdf.SetTitle(r.Title(), true)
+	pdf.AliasNbPages("")
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-15)
+		pdf.SetFont("Helvetica", "I", 8)
+		pdf.CellFormat(0, 10, fmt.Sprintf("page %d/{nb}", pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	width, _ := pdf.GetPageSize()
+	left, _, right, _ := pdf.GetMargins()
+	width -= left + right
+
+	pdf.AddPage()
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.CellFormat(0, 10, tr(r.Title()), "", 1, "L", false, 0, "")
+	for _, s := range r.sections() {
+		pdf.Ln(4)
+		pdf.SetFont("Helvetica", "B", 12)
+		pdf.CellFormat(0, 8, tr(s.Title), "", 1, "L", false, 0, "")
+
+		pdf.SetFont("Helvetica", "", 9)
+		if len(s.Text) == 0 && len(s.Rows) == 0 {
+			pdf.SetFont("Helvetica", "I", 9)
+			pdf.CellFormat(0, 5, "nothing to report", "", 1, "L", false, 0, "")
+			continue
+		}
+		for _, t := range s.Text {
+			pdf.MultiCell(0, 5, tr("- "+t), "", "L", false)
+		}
+		if len(s.Rows) == 0 {
+			continue
+		}
+		ws := columnWidths(pdf, s, width)
+		pdf.SetFont("Helvetica", "B", 9)
+		pdf.SetFillColor(230, 230, 230)
+		for i, h := range s.Headers {
+			pdf.CellFormat(ws[i], 6, tr(h), "1", 0, "L", true, 0, "")
+		}
+		pdf.Ln(-1)
+		pdf.SetFont("Helvetica", "", 9)
+		for _, row := range s.Rows {
+			for i, v := range row {
+				pdf.CellFormat(ws[i], 6, tr(truncateText(pdf, v, ws[i]-2)), "1", 0, "L", false, 0, "")
+			}
+			pdf.Ln(-1)
+		}
+	}
+	return pdf.Output(w)
+}
+
+// columnWidths shares the width of the page between the columns of a table
+// according to the widest value of each column.
+func columnWidths(pdf *gofpdf.Fpdf, s section, width float64) []float64 {
+	ws := make([]float64, len(s.Headers))
+	for i, h := range s.Headers {
+		ws[i] = pdf.GetStringWidth(h) + 4
+	}
+	for _, row := range s.Rows {
+		for i, v := range row {
+			if w := pdf.GetStringWidth(v) + 4; w > ws[i] {
+				ws[i] = w
+			}
+		}
+	}
+	var total float64
+	for _, w := range ws {
+		total += w
+	}
+	if total > 0 {
+		for i := range ws {
+			ws[i] = ws[i] * width / total
+		}
+	}
+	return ws
+}
+
+func truncateText(pdf *gofpdf.Fpdf, s string, width float64) string {
+	if pdf.GetStringWidth(s) <= width {
+		return s
+	}
+	rs := []rune(s)
+	for len(rs) > 0 && pdf.GetStringWidth(string(rs)+"...") > width {
+		rs = rs[:len(rs)-1]
+	}
+	return string(rs) + "..."
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+func formatPeriod(fd, td time.Time) string {
+	if fd.IsZero() {
+		return "-"
+	}
+	if td.IsZero() {
+		return formatTime(fd)
+	}
+	return formatTime(fd) + " - " + td.Format("15:04")
+}
+
+func slotName(s *Slot) string {
+	if s == nil {
+		return "-"
+	}
+	return s.Name
+}
+
+func fileName(f *File) string {
+	if f == nil {
+		return "-"
+	}
+	return f.Name
+}
+
+func eventName(e *Event) string {
+	if e == nil {
+		return "-"
+	}
+	return e.Summary
+}
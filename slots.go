@@ -2,6 +2,7 @@ package hourglass
 
 import (
 	"database/sql"
+	"fmt"
 	"time"
 
 	"github.com/lib/pq"
@@ -14,14 +15,28 @@ type Slot struct {
 	User     string    `json:"user"`
 	Lastmod  time.Time `json:"lastmod"`
 
-	File  string `json:"file"`
-	State string `json:"status"`
+	File     string `json:"file"`
+	State    string `json:"status"`
+	Checksum string `json:"checksum"`
 
-	Uplinks []*Uplink `json:"uplinks,omitempty"`
+	Uplinks  []*Uplink    `json:"uplinks,omitempty"`
+	Timeline []*Occupancy `json:"timeline,omitempty"`
+}
+
+type Occupancy struct {
+	Slot     int       `json:"slot"`
+	Name     string    `json:"name"`
+	Category string    `json:"category"`
+	Uplink   int       `json:"uplink"`
+	File     int       `json:"file"`
+	Filename string    `json:"filename"`
+	State    string    `json:"status"`
+	Starts   time.Time `json:"dtstart"`
+	Ends     time.Time `json:"dtend"`
 }
 
 func ListSlots(db *sql.DB, cs []string) ([]*Slot, error) {
-	const q = `select sid, name, category, person, file, state, lastmod from vslots where case when cardinality($1::varchar[])>0 then category = any($1::varchar[]) else true end`
+	const q = `select sid, name, category, person, file, state, lastmod, checksum from vslots where case when cardinality($1::varchar[])>0 then category = any($1::varchar[]) else true end`
 	rs, err := db.Query(q, pq.StringArray(cs))
 	if err != nil {
 		return nil, err
@@ -61,11 +76,60 @@ func ViewSlot(db *sql.DB, id int) (*Slot, error) {
 		data = append(data, u)
 	}
 	s.Uplinks = data
+	if s.Timeline, err = viewOccupancies(db, id); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
+func ListOccupancies(db *sql.DB, fd, td time.Time, cs []string) ([]*Occupancy, error) {
+	const q = `
+		select
+			slot, name, category, uplink, file, filename, state, dtstart, dtend
+		from voccupancies
+		where
+			dtstart<=$2 and (dtend is null or dtend>=$1)
+			and case when cardinality($3::varchar[])>0 then category=any($3::varchar[]) else true end
+		order by slot, dtstart`
+	rs, err := db.Query(q, fd.UTC(), td.UTC(), pq.StringArray(cs))
+	if err != nil {
+		return nil, err
+	}
+	return listOccupancies(rs)
+}
+
+func viewOccupancies(db *sql.DB, id int) ([]*Occupancy, error) {
+	const q = `select slot, name, category, uplink, file, filename, state, dtstart, dtend from voccupancies where slot=$1 order by dtstart`
+	rs, err := db.Query(q, id)
+	if err != nil {
+		return nil, err
+	}
+	return listOccupancies(rs)
+}
+
+func listOccupancies(rs *sql.Rows) ([]*Occupancy, error) {
+	defer rs.Close()
+
+	data := make([]*Occupancy, 0, 100)
+	for rs.Next() {
+		var (
+			o  Occupancy
+			td pq.NullTime
+		)
+		if err := rs.Scan(&o.Slot, &o.Name, &o.Category, &o.Uplink, &o.File, &o.Filename, &o.State, &o.Starts, &td); err != nil {
+			return nil, err
+		}
+		o.Starts = o.Starts.UTC()
+		if td.Valid {
+			o.Ends = td.Time.UTC()
+		}
+		data = append(data, &o)
+	}
+	return data, nil
+}
+
 func viewSlot(db *sql.DB, id int) (*Slot, error) {
-	const q = `select sid, name, category, person, file, state, lastmod from vslots where sid=$1`
+	const q = `select sid, name, category, person, file, state, lastmod, checksum from vslots where sid=$1`
 	s, err := scanSlots(db.QueryRow(q, id))
 	switch err {
 	default:
@@ -77,21 +141,150 @@ func viewSlot(db *sql.DB, id int) (*Slot, error) {
 	}
 }
 
-func NewSlot(db *sql.DB, s *Slot) error {
-	const q = `with c(pk) as (select pk from schedule.categories where name=$3), u(pk) as (select pk from vusers where initial=$4) insert into schedule.slots(pk, name, category, person) values($1, $2, (select pk from c), (select pk from u))`
-	_, err := db.Exec(q, s.Id, s.Name, s.Category, s.User)
-	return err
+func NewSlot(db *sql.DB, s *Slot) (err error) {
+	defer translate(&err)
+	const q = `with u(pk) as (select pk from vusers where initial=$4) insert into schedule.slots(pk, name, category, person) values($1, $2, $3, (select pk from u))`
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	cid, err := lookupCategory(tx, s.Category)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(q, s.Id, s.Name, cid, s.User); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
-func DeleteSlot(db *sql.DB, s *Slot) error {
+func DeleteSlot(db *sql.DB, s *Slot) (err error) {
+	defer translate(&err)
 	const q = `with u(pk) as (select pk from vusers where initial=$2) update schedule.slots set canceled=true, person=(select pk from u), lastmod=current_timestamp where pk=$1 and not canceled`
-	_, err := db.Exec(q, s.Id, s.User)
+	_, err = db.Exec(q, s.Id, s.User)
 	return err
 }
 
+func UpdateSlot(db *sql.DB, s *Slot) (err error) {
+	defer translate(&err)
+	const q = `
+		with
+			u(pk) as (select pk from vusers where initial=$3)
+		update schedule.slots set name=$1, category=$2, person=(select pk from u), lastmod=current_timestamp where pk=$4 and not canceled returning lastmod`
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	cid, err := lookupCategory(tx, s.Category)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	switch err := tx.QueryRow(q, s.Name, cid, s.User, s.Id).Scan(&s.Lastmod); err {
+	case nil:
+		return tx.Commit()
+	case sql.ErrNoRows:
+		tx.Rollback()
+		return ErrNotFound
+	default:
+		tx.Rollback()
+		return err
+	}
+}
+
+func RestoreSlot(db *sql.DB, s *Slot) (err error) {
+	defer translate(&err)
+	const q = `with u(pk) as (select pk from vusers where initial=$2) update schedule.slots set canceled=false, person=(select pk from u), lastmod=current_timestamp where pk=$1 and canceled returning lastmod`
+	switch err := db.QueryRow(q, s.Id, s.User).Scan(&s.Lastmod); err {
+	case nil:
+		return nil
+	case sql.ErrNoRows:
+		return ErrNotFound
+	default:
+		return err
+	}
+}
+
+// ImportSlots registers or replaces in a single transaction the slots given.
+// Slots already known with the same id are renamed, re-categorized and
+// restored if needed.
+func ImportSlots(db *sql.DB, ss []*Slot, u string) (err error) {
+	defer translate(&err)
+	if err := checkSlots(ss); err != nil {
+		return err
+	}
+	const q = `
+		with
+			u(pk) as (select pk from vusers where initial=$4)
+		insert into schedule.slots(pk, name, category, person) values($1, $2, $3, (select pk from u))
+		on conflict(pk) do update set name=excluded.name, category=excluded.category, person=excluded.person, canceled=false, lastmod=current_timestamp`
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	cs := make(map[string]int)
+	for _, s := range ss {
+		if _, ok := cs[s.Category]; ok {
+			continue
+		}
+		id, err := lookupCategory(tx, s.Category)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		cs[s.Category] = id
+	}
+	for _, s := range ss {
+		s.User = u
+		if _, err := tx.Exec(q, s.Id, s.Name, cs[s.Category], s.User); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func checkSlots(ss []*Slot) error {
+	var (
+		ids   = make(map[int]struct{})
+		names = make(map[string]struct{})
+	)
+	for _, s := range ss {
+		if s.Id <= 0 {
+			return slotError("uid", CodeInvalid, "slot %s: invalid id %d", s.Name, s.Id)
+		}
+		if s.Name == "" {
+			return slotError("name", CodeRequired, "slot %d: name is missing", s.Id)
+		}
+		if s.Category == "" {
+			return slotError("category", CodeRequired, "slot %s: category is missing", s.Name)
+		}
+		if _, ok := ids[s.Id]; ok {
+			return slotError("uid", CodeConflict, "slot %s: duplicate id %d", s.Name, s.Id)
+		}
+		if _, ok := names[s.Name]; ok {
+			return slotError("name", CodeConflict, "slot %d: duplicate name %s", s.Id, s.Name)
+		}
+		ids[s.Id], names[s.Name] = struct{}{}, struct{}{}
+	}
+	return nil
+}
+
+func slotError(field, code, msg string, args ...interface{}) error {
+	return Error{
+		Severity: SeverityError,
+		Source:   "slots",
+		Field:    field,
+		Code:     code,
+		Message:  fmt.Sprintf(msg, args...),
+	}
+}
+
 func scanSlots(s Scanner) (*Slot, error) {
 	i := new(Slot)
-	if err := s.Scan(&i.Id, &i.Name, &i.Category, &i.User, &i.File, &i.State, &i.Lastmod); err != nil {
+	if err := s.Scan(&i.Id, &i.Name, &i.Category, &i.User, &i.File, &i.State, &i.Lastmod, &i.Checksum); err != nil {
 		return nil, err
 	}
 	return i, nil
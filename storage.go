@@ -0,0 +1,217 @@
+package hourglass
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Store is the Storage used to save and retrieve the content of the files.
+var Store Storage = DBStorage{}
+
+type Content interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Storage keeps the content of the files. Content is identified by its SHA-256
+// digest.
+type Storage interface {
+	// Put saves the content read from r and gives back the bytes to be kept in
+	// the content column of schedule.files (if any).
+	Put(digest string, r io.Reader) ([]byte, error)
+	// Open gives a reader on the content of the file with the given id.
+	Open(db *sql.DB, id int) (Content, error)
+}
+
+// DBStorage keeps the content of the files in schedule.files as bytea. The
+// content has to be given at once to be inserted but it is read back by chunks.
+type DBStorage struct{}
+
+func (DBStorage) Put(_ string, r io.Reader) ([]byte, error) {
+	return ioutil.ReadAll(r)
+}
+
+func (DBStorage) Open(db *sql.DB, id int) (Content, error) {
+	const q = `select coalesce(length(content), 0) from schedule.files where pk=$1`
+	c := dbContent{db: db, id: id}
+	switch err := db.QueryRow(q, id).Scan(&c.size); err {
+	case nil:
+		return &c, nil
+	case sql.ErrNoRows:
+		return nil, ErrNotFound
+	default:
+		return nil, err
+	}
+}
+
+// dbChunk is the number of bytes of content read at once by dbContent.
+const dbChunk = 1 << 20
+
+// dbContent reads the content of a file stored in schedule.files by chunks of
+// dbChunk bytes.
+type dbContent struct {
+	db     *sql.DB
+	id     int
+	size   int64
+	offset int64
+
+	buf  []byte
+	base int64
+}
+
+func (c *dbContent) Read(bs []byte) (int, error) {
+	if c.offset >= c.size {
+		return 0, io.EOF
+	}
+	if c.offset < c.base || c.offset >= c.base+int64(len(c.buf)) {
+		const q = `select substring(content from $2 for $3) from schedule.files where pk=$1`
+		if err := c.db.QueryRow(q, c.id, c.offset+1, dbChunk).Scan(&c.buf); err != nil {
+			return 0, err
+		}
+		c.base = c.offset
+		if len(c.buf) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+	n := copy(bs, c.buf[c.offset-c.base:])
+	c.offset += int64(n)
+	return n, nil
+}
+
+func (c *dbContent) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.offset
+	case io.SeekEnd:
+		offset += c.size
+	default:
+		return 0, fmt.Errorf("seek: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek: negative position")
+	}
+	c.offset = offset
+	return offset, nil
+}
+
+func (c *dbContent) Close() error {
+	c.buf = nil
+	return nil
+}
+
+// DirStorage keeps the content of the files in a local directory, one file
+// per distinct content named after its digest. Identical contents are only
+// stored once.
+type DirStorage struct {
+	root string
+}
+
+func NewDirStorage(dir string) (*DirStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DirStorage{root: dir}, nil
+}
+
+func (d *DirStorage) Put(digest string, r io.Reader) ([]byte, error) {
+	if digest == "" {
+		return nil, nil
+	}
+	p := d.path(digest)
+	if _, err := os.Stat(p); err == nil {
+		// the content may be referenced by a transaction not yet committed:
+		// refresh its time so that Sweep does not remove it meanwhile.
+		now := time.Now()
+		return nil, os.Chtimes(p, now, now)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	w, err := ioutil.TempFile(filepath.Dir(p), "."+digest)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		os.Remove(w.Name())
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		os.Remove(w.Name())
+		return nil, err
+	}
+	return nil, os.Rename(w.Name(), p)
+}
+
+func (d *DirStorage) Open(db *sql.DB, id int) (Content, error) {
+	const q = `select coalesce(digest, '') from schedule.files where pk=$1`
+	var digest string
+	switch err := db.QueryRow(q, id).Scan(&digest); err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil, ErrNotFound
+	default:
+		return nil, err
+	}
+	if digest == "" {
+		return nopCloser{bytes.NewReader(nil)}, nil
+	}
+	return os.Open(d.path(digest))
+}
+
+// SweepGrace is the age below which Sweep leaves the content alone, giving the
+// transactions that wrote it the time to be committed.
+const SweepGrace = time.Hour
+
+// Sweep removes the content that is not referenced by any file (eg: the
+// content put by a transaction that has been rolled back) as well as the
+// temporary files left by failed writes. Only the files older than SweepGrace
+// are considered. It gives the number of files removed.
+func (d *DirStorage) Sweep(db *sql.DB) (int, error) {
+	const q = `select exists(select 1 from schedule.files where digest=$1)`
+	var (
+		count int
+		limit = time.Now().Add(-SweepGrace)
+	)
+	err := filepath.Walk(d.root, func(p string, i os.FileInfo, err error) error {
+		if err != nil || i.IsDir() || i.ModTime().After(limit) {
+			return err
+		}
+		if n := i.Name(); !strings.HasPrefix(n, ".") {
+			var used bool
+			if err := db.QueryRow(q, n).Scan(&used); err != nil || used {
+				return err
+			}
+		}
+		// check again in case Put has been called since the walk started.
+		if i, err := os.Stat(p); err != nil || i.ModTime().After(limit) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+func (d *DirStorage) path(digest string) string {
+	return filepath.Join(d.root, digest[:2], digest)
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
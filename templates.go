@@ -0,0 +1,263 @@
+package hourglass
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Template describes a procedure as a tree of steps from which todos can be
+// created.
+type Template struct {
+	Id      int       `json:"uid"`
+	Name    string    `json:"name"`
+	Summary string    `json:"summary"`
+	Steps   []*Step   `json:"steps"`
+	User    string    `json:"user"`
+	Lastmod time.Time `json:"lastmod"`
+}
+
+// Step is one todo of a template. Offset is the due time of the todo relative
+// to the anchor given when the template is instantiated (eg: -48h). Position
+// is the abbreviation of the position whose holders are assigned to the todo.
+type Step struct {
+	Summary     string                 `json:"summary"`
+	Description string                 `json:"description"`
+	Priority    string                 `json:"priority"`
+	Offset      string                 `json:"offset"`
+	Position    string                 `json:"position"`
+	Categories  []string               `json:"categories"`
+	Meta        map[string]interface{} `json:"metadata"`
+	Steps       []*Step                `json:"steps,omitempty"`
+}
+
+// Overrides customizes the todos created from a template.
+type Overrides struct {
+	// Event, if set, anchors the template on the dtstart of the event.
+	Event int `json:"event"`
+	// Assignees replaces the holders of a position by the given persons.
+	Assignees map[string][]string `json:"assignees"`
+	// Categories are added to every todo created.
+	Categories []string `json:"categories"`
+	User       string   `json:"-"`
+}
+
+func ListTemplates(db *sql.DB) ([]*Template, error) {
+	const q = `select pk, name, summary, steps, person, lastmod from vtemplates`
+	rs, err := db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	data := make([]*Template, 0, 100)
+	for rs.Next() {
+		t, err := scanTemplates(rs)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, t)
+	}
+	return data, nil
+}
+
+func ViewTemplate(db *sql.DB, id int) (*Template, error) {
+	const q = `select pk, name, summary, steps, person, lastmod from vtemplates where pk=$1`
+	t, err := scanTemplates(db.QueryRow(q, id))
+	switch err {
+	default:
+		return nil, err
+	case sql.ErrNoRows:
+		return nil, ErrNotFound
+	case nil:
+		return t, nil
+	}
+}
+
+func NewTemplate(db *sql.DB, t *Template) (err error) {
+	defer translate(&err)
+	const q = `with u(pk) as (select pk from vusers where initial=$4) insert into schedule.templates(name, summary, steps, person) values($1, nullif($2, ''), $3, (select pk from u)) returning pk, lastmod`
+	if err := checkSteps(t.Steps); err != nil {
+		return err
+	}
+	bs, err := json.Marshal(t.Steps)
+	if err != nil {
+		return err
+	}
+	return db.QueryRow(q, t.Name, t.Summary, bs, t.User).Scan(&t.Id, &t.Lastmod)
+}
+
+func UpdateTemplate(db *sql.DB, t *Template) (err error) {
+	defer translate(&err)
+	const q = `with u(pk) as (select pk from vusers where initial=$4) update schedule.templates set name=$1, summary=nullif($2, ''), steps=$3, person=(select pk from u), lastmod=current_timestamp where pk=$5 and not canceled returning lastmod`
+	if err := checkSteps(t.Steps); err != nil {
+		return err
+	}
+	bs, err := json.Marshal(t.Steps)
+	if err != nil {
+		return err
+	}
+	return db.QueryRow(q, t.Name, t.Summary, bs, t.User, t.Id).Scan(&t.Lastmod)
+}
+
+func DeleteTemplate(db *sql.DB, t *Template) (err error) {
+	defer translate(&err)
+	const q = `with u(pk) as (select pk from vusers where initial=$2) update schedule.templates set canceled=true, person=(select pk from u), lastmod=current_timestamp where pk=$1 and not canceled`
+	_, err = db.Exec(q, t.Id, t.User)
+	return err
+}
+
+// InstantiateTemplate creates the tree of todos described by a template. The
+// due time of each todo is computed from anchor (or the dtstart of the event
+// given in the overrides when anchor is zero). The whole tree is created in a
+// single transaction.
+func InstantiateTemplate(db *sql.DB, id int, anchor time.Time, o Overrides) (ts []*Todo, err error) {
+	defer translate(&err)
+	t, err := ViewTemplate(db, id)
+	if err != nil {
+		return nil, err
+	}
+	if anchor.IsZero() && o.Event > 0 {
+		e, err := ViewEvent(db, o.Event)
+		if err != nil {
+			return nil, err
+		}
+		anchor = e.Starts
+	}
+	if anchor.IsZero() {
+		return nil, Error{
+			Severity: SeverityError,
+			Source:   "templates",
+			Field:    "dtstart",
+			Code:     CodeRequired,
+			Message:  "anchor time or event is missing",
+		}
+	}
+	ps, err := listPositions(db)
+	if err != nil {
+		return nil, err
+	}
+	for p, as := range o.Assignees {
+		ps[p] = as
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if ts, err = instantiateSteps(tx, t.Steps, 0, anchor, ps, o); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return ts, tx.Commit()
+}
+
+func instantiateSteps(tx *sql.Tx, ss []*Step, parent int, anchor time.Time, ps map[string][]string, o Overrides) ([]*Todo, error) {
+	var ts []*Todo
+	for _, s := range ss {
+		d, err := parseOffset(s.Offset)
+		if err != nil {
+			return nil, err
+		}
+		t := Todo{
+			Id:          parent,
+			Summary:     s.Summary,
+			Description: s.Description,
+			Priority:    s.Priority,
+			State:       StateScheduled,
+			Due:         anchor.Add(d).UTC(),
+			Meta:        s.Meta,
+			Categories:  append(append([]string(nil), s.Categories...), o.Categories...),
+			Assignees:   ps[s.Position],
+			User:        o.User,
+		}
+		if t.Priority == "" {
+			t.Priority = "normal"
+		}
+		if err := createTodo(tx, &t); err != nil {
+			return nil, err
+		}
+		if err := linkTodo2Categories(tx, &t); err != nil {
+			return nil, err
+		}
+		if err := linkTodo2Assignees(tx, &t); err != nil {
+			return nil, err
+		}
+		if t.Todos, err = instantiateSteps(tx, s.Steps, t.Id, anchor, ps, o); err != nil {
+			return nil, err
+		}
+		ts = append(ts, &t)
+	}
+	return ts, nil
+}
+
+// listPositions gives the initials of the holders of each position.
+func listPositions(db *sql.DB) (map[string][]string, error) {
+	const q = `select o.abbr, array_agg(p.initial) from usoc.persons_positions j join usoc.positions o on j.position=o.pk join vusers p on j.person=p.pk group by o.abbr`
+	rs, err := db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	ps := make(map[string][]string)
+	for rs.Next() {
+		var (
+			p  string
+			as pq.StringArray
+		)
+		if err := rs.Scan(&p, &as); err != nil {
+			return nil, err
+		}
+		ps[p] = []string(as)
+	}
+	return ps, nil
+}
+
+func checkSteps(ss []*Step) error {
+	for _, s := range ss {
+		if s.Summary == "" {
+			return Error{Severity: SeverityError, Source: "templates", Field: "summary", Code: CodeRequired, Message: "step summary is missing"}
+		}
+		if _, err := parseOffset(s.Offset); err != nil {
+			return err
+		}
+		if err := checkSteps(s.Steps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseOffset(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, Error{
+			Severity: SeverityError,
+			Source:   "templates",
+			Field:    "offset",
+			Code:     CodeInvalid,
+			Message:  fmt.Sprintf("invalid offset %q", s),
+		}
+	}
+	return d, nil
+}
+
+func scanTemplates(s Scanner) (*Template, error) {
+	var (
+		t  Template
+		bs []byte
+	)
+	if err := s.Scan(&t.Id, &t.Name, &t.Summary, &bs, &t.User, &t.Lastmod); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bs, &t.Steps); err != nil && len(bs) > 0 {
+		return nil, err
+	}
+	return &t, nil
+}
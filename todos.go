@@ -3,11 +3,26 @@ package hourglass
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/lib/pq"
 )
 
+// TodoRollup controls how the state of a todo is tied to the state of its
+// subtasks. Both are disabled by default: states are independent unless the
+// rollup is enabled in the configuration.
+type TodoRollup struct {
+	// AutoComplete completes a todo once all its subtasks are completed. Todos
+	// aborted or canceled are left as they are.
+	AutoComplete bool `json:"complete"`
+	// Strict refuses to complete a todo while some of its subtasks are still
+	// open and reopens completed todos when one of their subtasks is reopened.
+	Strict bool `json:"strict"`
+}
+
+var Rollup TodoRollup
+
 type Todo struct {
 	Id          int                    `json:"uid"`
 	Summary     string                 `json:"summary"`
@@ -23,25 +38,82 @@ type Todo struct {
 	User        string                 `json:"user"`
 	Categories  []string               `json:"categories"`
 	Assignees   []string               `json:"assignees"`
+	Parent      int                    `json:"parent"`
+	Progress    int                    `json:"progress"`
 
+	Links    []*Link `json:"links,omitempty"`
 	Todos    []*Todo `json:"todos,omitempty"`
 	Versions []*Todo `json:"history,omitempty"`
 }
 
-func ListTodos(db *sql.DB, cs []string) ([]*Todo, error) {
-	const q = `select pk, summary, description, state, priority, person, version, meta, categories, assignees, dtstart, dtend, due, lastmod from vtodos where case when cardinality($1::varchar[])>0 then categories&&$1::varchar[] else true end`
-	rs, err := db.Query(q, pq.StringArray(cs))
+// TodoFilter restricts the todos given by ListTodos. Empty fields are ignored.
+type TodoFilter struct {
+	Categories []string
+	Assignees  []string
+	States     []string
+	Priorities []string
+	DueBefore  time.Time
+	DueAfter   time.Time
+	// Open only keeps the todos having at least one subtask still open.
+	Open bool
+}
+
+func ListTodos(db *sql.DB, f TodoFilter) ([]*Todo, error) {
+	rs, err := queryTodos(db, f)
 	if err != nil {
 		return nil, err
 	}
-	return listTodos(rs)
+	ts, err := listTodos(rs)
+	if err != nil {
+		return nil, err
+	}
+	return ts, listTodosLinks(db, ts)
+}
+
+// WalkTodos calls fn with each of the todos given by ListTodos as soon as it
+// is read, without their links. It stops at the first error returned by fn.
+func WalkTodos(db *sql.DB, f TodoFilter, fn func(*Todo) error) error {
+	rs, err := queryTodos(db, f)
+	if err != nil {
+		return err
+	}
+	defer rs.Close()
+	for rs.Next() {
+		t, err := scanTodos(rs)
+		if err != nil {
+			return err
+		}
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return rs.Err()
+}
+
+func queryTodos(db *sql.DB, f TodoFilter) (*sql.Rows, error) {
+	const q = `select
+			pk, summary, description, state, priority, person, version, meta, categories, assignees, dtstart, dtend, due, lastmod, coalesce(parent, 0), progress
+		from vtodos t
+		where
+			case when cardinality($1::varchar[])>0 then categories&&$1::varchar[] else true end
+			and case when cardinality($2::varchar[])>0 then assignees&&$2::varchar[] else true end
+			and case when cardinality($3::varchar[])>0 then state::varchar=any($3::varchar[]) else true end
+			and case when cardinality($4::varchar[])>0 then priority::varchar=any($4::varchar[]) else true end
+			and case when $5::timestamp is not null then due<$5 else true end
+			and case when $6::timestamp is not null then due>=$6 else true end
+			and case when $7 then exists(select 1 from schedule.todos s where s.parent=t.pk and not s.canceled and s.state not in ('completed', 'canceled', 'aborted')) else true end`
+	var (
+		before = pq.NullTime{Time: f.DueBefore.UTC(), Valid: !f.DueBefore.IsZero()}
+		after  = pq.NullTime{Time: f.DueAfter.UTC(), Valid: !f.DueAfter.IsZero()}
+	)
+	return db.Query(q, pq.StringArray(f.Categories), pq.StringArray(f.Assignees), pq.StringArray(f.States), pq.StringArray(f.Priorities), before, after, f.Open)
 }
 
 func ViewTodo(db *sql.DB, id int) (*Todo, error) {
 	const (
-		q = `select pk, summary, description, state, priority, person, version, meta, categories, assignees, dtstart, dtend, due, lastmod from vtodos where pk=$1`
-		h = `select pk, summary, description, state, priority, person, version, meta, categories, assignees, dtstart, dtend, due, lastmod from vtodos where parent=$1`
-		v = `select pk, summary, description, state, priority, person, version, meta, categories, assignees, dtstart, dtend, due, lastmod from revisions.vtodos where pk=$1`
+		q = `select pk, summary, description, state, priority, person, version, meta, categories, assignees, dtstart, dtend, due, lastmod, coalesce(parent, 0), progress from vtodos where pk=$1`
+		h = `select pk, summary, description, state, priority, person, version, meta, categories, assignees, dtstart, dtend, due, lastmod, coalesce(parent, 0), progress from vtodos where parent=$1`
+		v = `select pk, summary, description, state, priority, person, version, meta, categories, assignees, dtstart, dtend, due, lastmod, 0, 0 from revisions.vtodos where pk=$1`
 	)
 	t, err := scanTodos(db.QueryRow(q, id))
 	switch err {
@@ -71,11 +143,15 @@ func ViewTodo(db *sql.DB, id int) (*Todo, error) {
 	if err != nil {
 		return nil, err
 	}
+	if t.Links, err = listLinks(db, id, true); err != nil {
+		return nil, err
+	}
 
 	return t, nil
 }
 
-func NewTodo(db *sql.DB, t *Todo) error {
+func NewTodo(db *sql.DB, t *Todo) (err error) {
+	defer translate(&err)
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -92,10 +168,19 @@ func NewTodo(db *sql.DB, t *Todo) error {
 		tx.Rollback()
 		return err
 	}
+	if err := linkTodo2Links(tx, t.Id, t.Links); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := rollupTodo(tx, t); err != nil {
+		tx.Rollback()
+		return err
+	}
 	return tx.Commit()
 }
 
-func UpdateTodo(db *sql.DB, t *Todo) error {
+func UpdateTodo(db *sql.DB, t *Todo) (err error) {
+	defer translate(&err)
 	const q = `with u(pk) as (select pk from vusers where initial=$8) update schedule.todos set summary=$1, description=$2, state=$3, priority=$4, due=$5, dtstart=$6, dtend=$7, person=(select pk from u), meta=$9, lastmod=current_timestamp where pk=$10 returning lastmod`
 	m, err := json.Marshal(t.Meta)
 	if err != nil {
@@ -105,6 +190,12 @@ func UpdateTodo(db *sql.DB, t *Todo) error {
 	if err != nil {
 		return err
 	}
+	if t.State == StateCompleted && Rollup.Strict {
+		if err := checkSubtasks(tx, t.Id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
 	if err := tx.QueryRow(q, t.Summary, t.Description, t.State, t.Priority, t.Due, t.Starts, t.Ends, t.User, m, t.Id).Scan(&t.Lastmod); err != nil {
 		tx.Rollback()
 		return err
@@ -117,15 +208,174 @@ func UpdateTodo(db *sql.DB, t *Todo) error {
 		tx.Rollback()
 		return err
 	}
+	if err := rollupTodo(tx, t); err != nil {
+		tx.Rollback()
+		return err
+	}
 	return tx.Commit()
 }
 
-func DeleteTodo(db *sql.DB, t *Todo) error {
+// ReopenTodo sets back a completed todo to scheduled. If cascade is set, its
+// completed subtasks are reopened too.
+func ReopenTodo(db *sql.DB, t *Todo, cascade bool) (err error) {
+	defer translate(&err)
+	const (
+		c = `select state from schedule.todos where pk=$1 and not canceled for update`
+		q = `
+		with recursive sub(pk) as
+			(select pk from schedule.todos where parent=$1 and not canceled union all select ts.pk from schedule.todos ts join sub on ts.parent=sub.pk where not ts.canceled)
+		select pk from schedule.todos where pk in (select pk from sub) and state=$2`
+	)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var state string
+	switch err := tx.QueryRow(c, t.Id).Scan(&state); err {
+	case nil:
+	case sql.ErrNoRows:
+		tx.Rollback()
+		return ErrNotFound
+	default:
+		tx.Rollback()
+		return err
+	}
+	if state != StateCompleted {
+		tx.Rollback()
+		return Error{
+			Severity: SeverityError,
+			Source:   "todos",
+			Field:    "status",
+			Code:     CodeInvalid,
+			Message:  fmt.Sprintf("todo %d is %s and can not be reopened", t.Id, state),
+		}
+	}
+	ids := []int{t.Id}
+	if cascade {
+		rs, err := tx.Query(q, t.Id, StateCompleted)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		for rs.Next() {
+			var id int
+			if err := rs.Scan(&id); err != nil {
+				rs.Close()
+				tx.Rollback()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rs.Close()
+	}
+	for _, id := range ids {
+		if err := setTodoState(tx, id, StateScheduled, t.User); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	t.State = StateScheduled
+	if err := rollupTodo(tx, t); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func DeleteTodo(db *sql.DB, t *Todo) (err error) {
+	defer translate(&err)
 	const q = `with u(pk) as (select pk from vusers where initial=$2) update schedule.todos set canceled=true, lastmod=current_timestamp, person=(select pk from u) where pk=$1`
-	_, err := db.Exec(q, t.Id, t.User)
+	_, err = db.Exec(q, t.Id, t.User)
 	return err
 }
 
+// rollupTodo propagates the state of t to its ancestors: they are completed
+// once all their subtasks are completed (AutoComplete) or reopened when t is
+// not completed (Strict).
+func rollupTodo(tx *sql.Tx, t *Todo) error {
+	const q = `select coalesce(p.pk, 0), coalesce(p.state, 'n/a') from schedule.todos t left outer join schedule.todos p on t.parent=p.pk and not p.canceled where t.pk=$1`
+
+	id := t.Id
+	for {
+		var (
+			pid   int
+			state string
+		)
+		if err := tx.QueryRow(q, id).Scan(&pid, &state); err != nil {
+			return err
+		}
+		if pid == 0 {
+			return nil
+		}
+		switch {
+		case state == StateAborted || state == StateCanceled:
+			return nil
+		case t.State == StateCompleted && Rollup.AutoComplete && state != StateCompleted:
+			switch err := checkSubtasks(tx, pid); err.(type) {
+			case nil:
+			case Error:
+				return nil
+			default:
+				return err
+			}
+			if err := setTodoState(tx, pid, StateCompleted, t.User); err != nil {
+				return err
+			}
+		case t.State != StateCompleted && Rollup.Strict && state == StateCompleted:
+			if err := setTodoState(tx, pid, StateScheduled, t.User); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		id = pid
+	}
+}
+
+// checkSubtasks returns an error if the todo has subtasks still open.
+func checkSubtasks(tx *sql.Tx, id int) error {
+	const q = `select count(pk) from schedule.todos where parent=$1 and not canceled and state not in ('completed', 'canceled', 'aborted')`
+	var n int
+	if err := tx.QueryRow(q, id).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+	return Error{
+		Severity: SeverityError,
+		Source:   "todos",
+		Field:    "status",
+		Code:     CodeConflict,
+		Message:  fmt.Sprintf("todo %d has %d open subtask(s)", id, n),
+	}
+}
+
+// setTodoState changes the state of a todo. Since the revision trigger drops
+// the links of the todo, categories and assignees are linked again.
+func setTodoState(tx *sql.Tx, id int, state, user string) error {
+	const (
+		q = `select categories, assignees from vtodos where pk=$1`
+		u = `with u(pk) as (select pk from vusers where initial=$3) update schedule.todos set state=$2, person=coalesce((select pk from u), person), lastmod=current_timestamp where pk=$1`
+	)
+	var (
+		cs, as pq.StringArray
+		t      = Todo{Id: id}
+	)
+	if err := tx.QueryRow(q, id).Scan(&cs, &as); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(u, id, state, user); err != nil {
+		return err
+	}
+	t.Categories, t.Assignees = []string(cs), []string(as)
+	if err := linkTodo2Categories(tx, &t); err != nil {
+		return err
+	}
+	return linkTodo2Assignees(tx, &t)
+}
+
 func createTodo(tx *sql.Tx, t *Todo) error {
 	const q = `with u(pk) as
 		(select pk from vusers where initial=$8)
@@ -139,9 +389,13 @@ func createTodo(tx *sql.Tx, t *Todo) error {
 }
 
 func linkTodo2Categories(tx *sql.Tx, t *Todo) error {
-	const q = ` with c(pk) as (select pk from schedule.categories where name=$2) insert into schedule.todos_categories(todo, category) values($1, (select pk from c))`
+	const q = `insert into schedule.todos_categories(todo, category) values($1, $2) on conflict do nothing`
 	for _, c := range t.Categories {
-		if _, err := tx.Exec(q, t.Id, c); err != nil {
+		cid, err := lookupCategory(tx, c)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(q, t.Id, cid); err != nil {
 			return err
 		}
 	}
@@ -180,7 +434,7 @@ func scanTodos(s Scanner) (*Todo, error) {
 		fd, td pq.NullTime
 		m      []byte
 	)
-	if err := s.Scan(&t.Id, &t.Summary, &t.Description, &t.State, &t.Priority, &t.User, &t.Version, &m, &cs, &as, &fd, &td, &t.Due, &t.Lastmod); err != nil {
+	if err := s.Scan(&t.Id, &t.Summary, &t.Description, &t.State, &t.Priority, &t.User, &t.Version, &m, &cs, &as, &fd, &td, &t.Due, &t.Lastmod, &t.Parent, &t.Progress); err != nil {
 		return nil, err
 	}
 
@@ -2,6 +2,8 @@ package hourglass
 
 import (
 	"database/sql"
+	"encoding/hex"
+	"io"
 	"time"
 
 	"github.com/lib/pq"
@@ -13,10 +15,16 @@ type Uplink struct {
 	Status  string    `json:"status"`
 	User    string    `json:"user"`
 	Lastmod time.Time `json:"lastmod"`
+	// Algorithm is the checksum algorithm expected by the target of the slot
+	// category and Checksum the value of the file for it.
+	Algorithm string `json:"algorithm"`
+	Checksum  string `json:"checksum"`
 
 	*Slot  `json:"slot"`
 	*Event `json:"event"`
 	*File  `json:"file"`
+
+	Todos []*Todo `json:"todos,omitempty"`
 }
 
 type Transfer struct {
@@ -64,7 +72,14 @@ func ListDownlinks(db *sql.DB, fd, td time.Time, cs, ts []string) ([]*Uplink, er
 
 func ViewDownlink(db *sql.DB, id int) (*Uplink, error) {
 	const q = `select pk, '', state, person, lastmod, slot, event, file from vdownlinks where pk=$1`
-	return scanUplink(db.QueryRow(q, id), db)
+	u, err := scanUplink(db.QueryRow(q, id), db)
+	if err != nil {
+		return nil, err
+	}
+	if u.Todos, err = listLinkedTodos(db, LinkUplink, u.Id); err != nil {
+		return nil, err
+	}
+	return u, nil
 }
 
 func NewDownlink(db *sql.DB, e, s, f int, u string) (*Uplink, error) {
@@ -95,6 +110,10 @@ func ListTransfers(db *sql.DB, fd, td time.Time, cs, ts []string) ([]*Transfer,
 	default:
 		return nil, err
 	}
+	return listTransfers(db, rs)
+}
+
+func listTransfers(db *sql.DB, rs *sql.Rows) ([]*Transfer, error) {
 	defer rs.Close()
 	data := make([]*Transfer, 0, 100)
 	for rs.Next() {
@@ -138,6 +157,7 @@ func NewTransfer(db *sql.DB, i, e int, u, d string) (*Transfer, error) {
 		insert into schedule.transfers(uplink, event, person, location) values($1, (select pk from e), (select pk from u), $4) returning pk`
 	var id int
 	if err := db.QueryRow(q, i, e, u, d).Scan(&id); err != nil {
+		translate(&err)
 		return nil, err
 	}
 	return ViewTransfer(db, id)
@@ -149,6 +169,7 @@ func UpdateTransfer(db *sql.DB, id int, s, u string) (*Transfer, error) {
 			u(pk) as (select pk from vusers where initial=$3 limit 1)
 		update schedule.transfers set state=$2, person=(select pk from u), lastmod=current_timestamp where pk=$1`
 	if _, err := db.Exec(q, id, s, u); err != nil {
+		translate(&err)
 		return nil, err
 	}
 	return ViewTransfer(db, id)
@@ -167,6 +188,11 @@ func ListUplinks(db *sql.DB, fd, td time.Time, cs, ts []string) ([]*Uplink, erro
 	if err != nil {
 		return nil, err
 	}
+	return listUplinks(db, rs)
+}
+
+func listUplinks(db *sql.DB, rs *sql.Rows) ([]*Uplink, error) {
+	defer rs.Close()
 	data := make([]*Uplink, 0, 100)
 	for rs.Next() {
 		u, err := scanUplink(rs, db)
@@ -178,9 +204,18 @@ func ListUplinks(db *sql.DB, fd, td time.Time, cs, ts []string) ([]*Uplink, erro
 	return data, nil
 }
 
+// ViewUplink gives the uplink id, even if a later uplink has replaced it in its
+// slot.
 func ViewUplink(db *sql.DB, id int) (*Uplink, error) {
-	const q = `select pk, dropbox, state, person, lastmod, slot, event, file from vuplinks where pk=$1`
-	return scanUplink(db.QueryRow(q, id), db)
+	const q = `select pk, dropbox, state, person, lastmod, slot, event, file from vuplinkshistory where pk=$1`
+	u, err := scanUplink(db.QueryRow(q, id), db)
+	if err != nil {
+		return nil, err
+	}
+	if u.Todos, err = listLinkedTodos(db, LinkUplink, u.Id); err != nil {
+		return nil, err
+	}
+	return u, nil
 }
 
 func NewUplink(db *sql.DB, s, e, f int, u string) (*Uplink, error) {
@@ -194,7 +229,8 @@ func UpdateUplink(db *sql.DB, id int, s, u string) (*Uplink, error) {
 	return ViewUplink(db, id)
 }
 
-func updateUplink(db *sql.DB, id int, s, u string) error {
+func updateUplink(db *sql.DB, id int, s, u string) (err error) {
+	defer translate(&err)
 	const q = `
 		with
 			u(pk) as (select pk from vusers where initial=$3 limit 1)
@@ -208,7 +244,7 @@ func updateUplink(db *sql.DB, id int, s, u string) error {
 func createUplink(db *sql.DB, slot, event, file int, user string, dummy bool) (*Uplink, error) {
 	const q = `
 		with
-			f(pk) as(select pk from schedule.files where pk=$3 and case when $4::boolean then (content is null or length(content)=0) else (content is not null and length(content)>0) end),
+			f(pk) as(select pk from schedule.files where pk=$3 and case when $4::boolean then length=0 else length>0 end),
 			u(pk) as (select pk from vusers where initial=$5 limit 1),
 			e(pk) as (select pk from schedule.events where source is null and pk=$2 and not canceled)
 		insert into schedule.uplinks(slot, event, file, person) values($1, (select pk from e), (select pk from f), (select pk from u)) returning pk`
@@ -219,8 +255,27 @@ func createUplink(db *sql.DB, slot, event, file int, user string, dummy bool) (*
 	// 		e(pk) as (select pk from schedule.events where source is null and pk=$2 and not canceled)
 	// 	insert into schedule.uplinks(slot, event, file, person) values($1, (select pk from e), (select pk from f), (select pk from u)) returning pk`
 
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if !dummy {
+		if err := checkSlotAvailable(tx, slot, event); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err := linkUplink2Checksum(db, tx, slot, file); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
 	var id int
-	if err := db.QueryRow(q, slot, event, file, dummy, user).Scan(&id); err != nil {
+	if err := tx.QueryRow(q, slot, event, file, dummy, user).Scan(&id); err != nil {
+		tx.Rollback()
+		translate(&err)
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
 		return nil, err
 	}
 	if dummy {
@@ -230,6 +285,41 @@ func createUplink(db *sql.DB, slot, event, file int, user string, dummy bool) (*
 	}
 }
 
+// checkSlotAvailable refuses to schedule an uplink into a slot while another
+// uplink, not yet executed, still needs the slot during the same event or an
+// overlapping one.
+func checkSlotAvailable(tx *sql.Tx, slot, event int) error {
+	const (
+		k = `select pk from schedule.slots where pk=$1 for update`
+		q = `
+		select
+			u.pk
+		from schedule.uplinks u
+			join schedule.events e on u.event=e.pk
+			join schedule.events n on n.pk=$2
+			join schedule.files f on u.file=f.pk
+		where
+			u.slot=$1
+			and u.state in ('tentative', 'scheduled', 'on going')
+			and not e.canceled
+			and f.length>0
+			and (e.pk=n.pk or (coalesce(e.rtstart, e.dtstart), coalesce(e.rtend, e.dtend)) overlaps (coalesce(n.rtstart, n.dtstart), coalesce(n.rtend, n.dtend)))
+		limit 1`
+	)
+	var id int
+	if err := tx.QueryRow(k, slot).Scan(&id); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	switch err := tx.QueryRow(q, slot, event).Scan(&id); err {
+	case sql.ErrNoRows:
+		return nil
+	case nil:
+		return ErrConflict
+	default:
+		return err
+	}
+}
+
 func scanUplink(sc Scanner, db *sql.DB) (*Uplink, error) {
 	var s, f, e int
 	u := new(Uplink)
@@ -243,6 +333,58 @@ func scanUplink(sc Scanner, db *sql.DB) (*Uplink, error) {
 		u.Slot, _ = viewSlot(db, s)
 		u.Event, _ = ViewEvent(db, e)
 		u.File, _ = ViewFile(db, f, false, false)
+		u.Algorithm = CRC16
+		if u.Slot != nil && u.Slot.Checksum != "" {
+			u.Algorithm = u.Slot.Checksum
+		}
+		if u.File != nil {
+			u.Checksum = u.File.Checksums[u.Algorithm]
+		}
 		return u, nil
 	}
 }
+
+// linkUplink2Checksum makes sure that the file of an uplink has a value for
+// the checksum algorithm of the slot category. Files created before the
+// algorithm was registered get it computed from their content.
+func linkUplink2Checksum(db *sql.DB, tx *sql.Tx, slot, file int) error {
+	const (
+		q = `
+			select
+				coalesce(c.checksum, ''),
+				exists(select 1 from schedule.files_checksums k where k.file=$2 and k.algorithm=c.checksum)
+			from schedule.slots s
+				join schedule.categories c on s.category=c.pk
+			where s.pk=$1`
+		i = `insert into schedule.files_checksums(file, algorithm, value) values($1, $2, $3)`
+	)
+	var (
+		algo string
+		ok   bool
+	)
+	switch err := tx.QueryRow(q, slot, file).Scan(&algo, &ok); err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil
+	default:
+		return err
+	}
+	if algo == "" || ok {
+		return nil
+	}
+	h, err := newChecksum(algo)
+	if err != nil {
+		return err
+	}
+	c, err := Store.Open(db, file)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if _, err := io.Copy(h, c); err != nil {
+		return err
+	}
+	_, err = tx.Exec(i, file, algo, hex.EncodeToString(h.Sum(nil)))
+	return err
+}
@@ -47,7 +47,7 @@ func ViewUser(db *sql.DB, id int) (*User, error) {
 		q = `select pk, firstname, lastname, initial, email, internal, positions from vusers where pk=$1`
 		s = `select settings from vusers where pk=$1`
 		e = `select pk, source, summary, description, meta, state, version, dtstart, dtend, rtstart, rtend, person, attendees, categories, lastmod from vevents where $1=any(attendees)`
-		t = `select pk, summary, description, state, priority, person, version, meta, categories, assignees, dtstart, dtend, due, lastmod from vtodos where $1=any(assignees)`
+		t = `select pk, summary, description, state, priority, person, version, meta, categories, assignees, dtstart, dtend, due, lastmod, coalesce(parent, 0), progress from vtodos where $1=any(assignees)`
 	)
 	u, err := scanUsers(db.QueryRow(q, id))
 	switch err {
@@ -102,12 +102,14 @@ func UpdateUser(db *sql.DB, u *User) (*User, error) {
 		return nil, err
 	}
 	if _, err := db.Exec(q, u.First, u.Last, u.Initial, u.Email, u.Internal, bs, u.Id); err != nil {
+		translate(&err)
 		return nil, err
 	}
 	return ViewUser(db, u.Id)
 }
 
-func UpdatePasswd(db *sql.DB, u *User, old, passwd string) error {
+func UpdatePasswd(db *sql.DB, u *User, old, passwd string) (err error) {
+	defer translate(&err)
 	const (
 		e = `select pk from usoc.persons where pk=$1 and passwd=encode(digest($2, 'sha256'), 'hex')`
 		q = `update usoc.persons set passwd=encode(digest($1, 'sha256'), 'hex') where pk=$2 and passwd=encode(digest($3, 'sha256'), 'hex')`
@@ -115,11 +117,12 @@ func UpdatePasswd(db *sql.DB, u *User, old, passwd string) error {
 	if err := db.QueryRow(e, u.Id, old).Scan(&u.Id); err != nil {
 		return err
 	}
-	_, err := db.Exec(q, passwd, u.Id, old)
+	_, err = db.Exec(q, passwd, u.Id, old)
 	return err
 }
 
-func RegisterUser(db *sql.DB, u *User, passwd string) error {
+func RegisterUser(db *sql.DB, u *User, passwd string) (err error) {
+	defer translate(&err)
 	const q = `insert into usoc.persons(firstname, lastname, initial, email, internal, passwd) values($1, $2, $3, $4, $5, encode(digest($6, 'sha256'), 'hex')) returning pk`
 	if err := db.QueryRow(q, u.First, u.Last, u.Initial, u.Email, u.Internal, passwd).Scan(&u.Id); err != nil {
 		return err
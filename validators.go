@@ -0,0 +1,300 @@
+package hourglass
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Errors is the list of violations found when validating a file.
+type Errors []Error
+
+func (es Errors) Error() string {
+	vs := make([]string, len(es))
+	for i, e := range es {
+		vs[i] = fmt.Sprintf("%s: %s", e.Source, e.Message)
+	}
+	return strings.Join(vs, "; ")
+}
+
+// Validator checks a file before it is inserted. It returns the violations
+// found, if any.
+type Validator interface {
+	Validate(*File) []Error
+}
+
+type ValidatorFunc func(*File) []Error
+
+func (fn ValidatorFunc) Validate(f *File) []Error {
+	return fn(f)
+}
+
+var validators = struct {
+	sync.RWMutex
+	set map[string][]Validator
+}{set: make(map[string][]Validator)}
+
+// RegisterValidator adds a Validator for the files of the given category. An
+// empty category applies the validator to every file.
+func RegisterValidator(category string, v Validator) {
+	validators.Lock()
+	defer validators.Unlock()
+	validators.set[category] = append(validators.set[category], v)
+}
+
+// validateFile runs the validators registered for the categories of f. Only
+// violations with severity error are reported as an error, warnings are kept
+// in f.
+func validateFile(f *File) error {
+	validators.RLock()
+	defer validators.RUnlock()
+
+	f.measure()
+
+	var es Errors
+	cs := append([]string{""}, f.Categories...)
+	for _, c := range cs {
+		for _, v := range validators.set[c] {
+			es = append(es, v.Validate(f)...)
+		}
+	}
+	f.Warnings = f.Warnings[:0]
+	var errs Errors
+	for _, e := range es {
+		if e.Code == "" {
+			e.Code = CodeInvalid
+		}
+		if e.Severity == SeverityError {
+			errs = append(errs, e)
+		} else {
+			f.Warnings = append(f.Warnings, e)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// MaxSize refuses files whose content is larger than n bytes.
+func MaxSize(n int) Validator {
+	fn := func(f *File) []Error {
+		if f.Length <= n {
+			return nil
+		}
+		e := Error{
+			Severity: SeverityError,
+			Source:   "size",
+			Field:    "content",
+			Message:  fmt.Sprintf("content too large (%d > %d bytes)", f.Length, n),
+		}
+		return []Error{e}
+	}
+	return ValidatorFunc(fn)
+}
+
+// AllowNames refuses files whose name does not match one of the given
+// patterns (see filepath.Match). Extensions are given as "*.ext".
+func AllowNames(patterns ...string) Validator {
+	fn := func(f *File) []Error {
+		for _, p := range patterns {
+			if ok, _ := filepath.Match(p, f.Name); ok {
+				return nil
+			}
+		}
+		e := Error{
+			Severity: SeverityError,
+			Source:   "name",
+			Field:    "name",
+			Message:  fmt.Sprintf("%s does not match any of %s", f.Name, strings.Join(patterns, ", ")),
+		}
+		return []Error{e}
+	}
+	return ValidatorFunc(fn)
+}
+
+// WellFormedJSON refuses files whose content is not valid JSON.
+func WellFormedJSON() Validator {
+	fn := func(f *File) []Error {
+		if f.Length == 0 || validJSON(f.Reader()) {
+			return nil
+		}
+		e := Error{
+			Severity: SeverityError,
+			Source:   "json",
+			Field:    "content",
+			Message:  "content is not valid JSON",
+		}
+		return []Error{e}
+	}
+	return ValidatorFunc(fn)
+}
+
+// validJSON tells if r gives exactly one JSON value without keeping it in
+// memory.
+func validJSON(r io.Reader) bool {
+	var (
+		d     = json.NewDecoder(r)
+		depth int
+		done  bool
+	)
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return done && depth == 0
+		}
+		if err != nil || done {
+			return false
+		}
+		switch t {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		done = depth == 0
+	}
+}
+
+// WellFormedXML refuses files whose content is not well formed XML.
+func WellFormedXML() Validator {
+	fn := func(f *File) []Error {
+		d := xml.NewDecoder(f.Reader())
+		for {
+			_, err := d.Token()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				e := Error{
+					Severity: SeverityError,
+					Source:   "xml",
+					Field:    "content",
+					Message:  err.Error(),
+				}
+				return []Error{e}
+			}
+		}
+	}
+	return ValidatorFunc(fn)
+}
+
+type rule struct {
+	kind    string
+	re      *regexp.Regexp
+	message string
+}
+
+// MaxLineLength is the length of the longest line accepted by Rules.
+const MaxLineLength = 1 << 20
+
+// Rules checks the content of text files line by line.
+type Rules struct {
+	source string
+	rules  []rule
+}
+
+// LoadRules reads a rule file. Each line of the file gives a kind, a regular
+// expression and an optional message, separated by blanks (use \s to match a
+// blank in the expression). Empty lines and lines starting with # are
+// ignored. Kinds are:
+//
+//	allow: every non empty line of the content should match one allow rule
+//	deny:  lines matching the expression are reported as errors
+//	warn:  lines matching the expression are reported as warnings
+func LoadRules(file string) (*Rules, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	rs := Rules{source: filepath.Base(file)}
+	s := bufio.NewScanner(r)
+	for i := 1; s.Scan(); i++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fs := strings.Fields(line)
+		if len(fs) < 2 {
+			return nil, fmt.Errorf("%s:%d: missing expression", file, i)
+		}
+		switch fs[0] {
+		case "allow", "deny", "warn":
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown rule %s", file, i, fs[0])
+		}
+		re, err := regexp.Compile(fs[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, i, err)
+		}
+		msg := strings.Join(fs[2:], " ")
+		if msg == "" {
+			msg = fmt.Sprintf("line matches %s", fs[1])
+		}
+		rs.rules = append(rs.rules, rule{kind: fs[0], re: re, message: msg})
+	}
+	return &rs, s.Err()
+}
+
+func (rs *Rules) Validate(f *File) []Error {
+	var (
+		es    []Error
+		allow bool
+	)
+	for _, r := range rs.rules {
+		if r.kind == "allow" {
+			allow = true
+			break
+		}
+	}
+	s := bufio.NewScanner(f.Reader())
+	s.Buffer(make([]byte, 0, 64*1024), MaxLineLength)
+
+	var i int
+	for i = 1; s.Scan(); i++ {
+		line := s.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		src := fmt.Sprintf("%s:%d", rs.source, i)
+		matched := false
+		for _, r := range rs.rules {
+			if !r.re.MatchString(line) {
+				continue
+			}
+			switch r.kind {
+			case "allow":
+				matched = true
+			case "deny":
+				es = append(es, Error{Severity: SeverityError, Source: src, Field: "content", Message: r.message})
+			case "warn":
+				es = append(es, Error{Severity: SeverityWarning, Source: src, Field: "content", Message: r.message})
+			}
+		}
+		if allow && !matched {
+			es = append(es, Error{Severity: SeverityError, Source: src, Field: "content", Message: "line does not match any allowed syntax"})
+		}
+	}
+	if err := s.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			err = fmt.Errorf("line longer than %d bytes", MaxLineLength)
+		}
+		src := fmt.Sprintf("%s:%d", rs.source, i)
+		es = append(es, Error{Severity: SeverityError, Source: src, Field: "content", Message: err.Error()})
+	}
+	return es
+}
@@ -0,0 +1,134 @@
+package hourglass
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+)
+
+// Gap is a period without any event.
+type Gap struct {
+	Starts   time.Time `json:"dtstart"`
+	Ends     time.Time `json:"dtend"`
+	Duration float64   `json:"duration"`
+}
+
+// Load is the number of events overlapping from When until the next Load of
+// a series.
+type Load struct {
+	When  time.Time `json:"dtstamp"`
+	Level int       `json:"level"`
+}
+
+// Workload describes how busy a period is: its free windows longer than a
+// threshold and the number of concurrent events over time.
+type Workload struct {
+	Starts time.Time `json:"dtstart"`
+	Ends   time.Time `json:"dtend"`
+	Peak   int       `json:"peak"`
+	Gaps   []*Gap    `json:"gaps"`
+	Series []*Load   `json:"series"`
+}
+
+// AnalyzeWorkload computes the gaps and the concurrency level of the events
+// selected by ListEvents with the same arguments. Only the gaps at least as
+// long as threshold are kept.
+func AnalyzeWorkload(db *sql.DB, f, t time.Time, cs, vs []string, threshold time.Duration) (*Workload, error) {
+	if f.IsZero() && t.IsZero() {
+		f = time.Now().Truncate(time.Hour * 24)
+		t = f.Add(time.Hour * 24)
+	}
+	es, err := ListEvents(db, f, t, cs, vs)
+	if err != nil {
+		return nil, err
+	}
+	w := Workload{Starts: f.UTC(), Ends: t.UTC()}
+	w.Gaps = findGaps(es, w.Starts, w.Ends, threshold)
+	w.Series, w.Peak = concurrency(es, w.Starts, w.Ends)
+	return &w, nil
+}
+
+type span struct {
+	starts, ends time.Time
+}
+
+// spans gives the planned periods of the events, clipped to [f, t] and sorted
+// by start. Canceled and aborted events are not a load and are skipped.
+func spans(es []*Event, f, t time.Time) []span {
+	ss := make([]span, 0, len(es))
+	for _, e := range es {
+		if e.State == StateCanceled || e.State == StateAborted {
+			continue
+		}
+		s := span{starts: e.Starts, ends: e.Ends}
+		if s.starts.Before(f) {
+			s.starts = f
+		}
+		if s.ends.After(t) {
+			s.ends = t
+		}
+		if !s.ends.After(s.starts) {
+			continue
+		}
+		ss = append(ss, s)
+	}
+	sort.Slice(ss, func(i, j int) bool { return ss[i].starts.Before(ss[j].starts) })
+	return ss
+}
+
+func findGaps(es []*Event, f, t time.Time, threshold time.Duration) []*Gap {
+	var (
+		gs   []*Gap
+		last = f
+	)
+	add := func(fd, td time.Time) {
+		if d := td.Sub(fd); d > 0 && d >= threshold {
+			gs = append(gs, &Gap{Starts: fd, Ends: td, Duration: d.Seconds()})
+		}
+	}
+	for _, s := range spans(es, f, t) {
+		if s.starts.After(last) {
+			add(last, s.starts)
+		}
+		if s.ends.After(last) {
+			last = s.ends
+		}
+	}
+	add(last, t)
+	return gs
+}
+
+// concurrency gives the number of overlapping events each time it changes.
+func concurrency(es []*Event, f, t time.Time) ([]*Load, int) {
+	ss := spans(es, f, t)
+	deltas := make(map[time.Time]int)
+	for _, s := range ss {
+		deltas[s.starts]++
+		deltas[s.ends]--
+	}
+	ws := make([]time.Time, 0, len(deltas)+1)
+	for w := range deltas {
+		ws = append(ws, w)
+	}
+	if _, ok := deltas[f]; !ok {
+		ws = append(ws, f)
+	}
+	sort.Slice(ws, func(i, j int) bool { return ws[i].Before(ws[j]) })
+
+	var (
+		ls    []*Load
+		level int
+		peak  int
+	)
+	for _, w := range ws {
+		level += deltas[w]
+		if level > peak {
+			peak = level
+		}
+		if n := len(ls); n > 0 && ls[n-1].Level == level {
+			continue
+		}
+		ls = append(ls, &Load{When: w, Level: level})
+	}
+	return ls, peak
+}